@@ -0,0 +1,215 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"gitlab.utc.fr/cmbouopd/migration.git/engine"
+)
+
+// checkpointQueue is the number of checkpoints waiting to be written before
+// new ones are skipped.
+const checkpointQueue = 4
+
+// checkpoints writes the checkpoints of every session; nil when autosave is
+// off.
+var checkpoints *checkpointer
+
+// autosavePolicy tells when sessions are checkpointed: every Ticks ticks
+// and every Interval, whichever comes first. Only the Keep most recent
+// checkpoints of a session are kept.
+type autosavePolicy struct {
+	Ticks    int
+	Interval time.Duration
+	Keep     int
+}
+
+func (p autosavePolicy) enabled() bool {
+	return p.Ticks > 0 || p.Interval > 0
+}
+
+type checkpoint struct {
+	sessionID string
+	snapshot  sessionSnapshot
+}
+
+// checkpointer writes checkpoints to the database on its own goroutine, so
+// that session loops only pay for a snapshot of their state. Deleting the
+// checkpoints of a removed session is queued apart, so that it never waits
+// for room in the queue.
+type checkpointer struct {
+	policy autosavePolicy
+	queue  chan checkpoint
+	wake   chan struct{} // Signals forgets to the writer
+	done   chan struct{}
+
+	mu        sync.Mutex // Guards sending on queue against closing it
+	closed    bool
+	forgotten map[string]bool // Sessions whose checkpoints were deleted
+	forgets   []string        // Sessions whose checkpoints are to be deleted
+}
+
+func newCheckpointer(policy autosavePolicy) *checkpointer {
+	c := &checkpointer{
+		policy:    policy,
+		queue:     make(chan checkpoint, checkpointQueue),
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		forgotten: make(map[string]bool),
+	}
+	go c.run()
+	return c
+}
+
+func (c *checkpointer) run() {
+	defer close(c.done)
+	for {
+		select {
+		case cp, ok := <-c.queue:
+			if !ok {
+				c.deleteForgotten()
+				return
+			}
+			c.write(cp)
+		case <-c.wake:
+			c.deleteForgotten()
+		}
+	}
+}
+
+// write saves a checkpoint, unless its session was removed since it was
+// queued.
+func (c *checkpointer) write(cp checkpoint) {
+	c.mu.Lock()
+	forgotten := c.forgotten[cp.sessionID]
+	c.mu.Unlock()
+	if forgotten {
+		return
+	}
+	info, err := insertSave(cp.snapshot, saveInfo{Name: "autosave", Simulation: cp.sessionID, Checkpoint: true})
+	if err != nil {
+		log.Printf("checkpoint of simulation %s: %v", cp.sessionID, err)
+		return
+	}
+	if err := pruneCheckpoints(cp.sessionID, c.policy.Keep); err != nil {
+		log.Printf("checkpoint of simulation %s: %v", cp.sessionID, err)
+	}
+	log.Printf("checkpoint %d of simulation %s at tick %d", info.ID, cp.sessionID, info.Tick)
+}
+
+// deleteForgotten deletes the checkpoints of the sessions forgotten since it
+// last ran.
+func (c *checkpointer) deleteForgotten() {
+	c.mu.Lock()
+	forgets := c.forgets
+	c.forgets = nil
+	c.mu.Unlock()
+	for _, sessionID := range forgets {
+		if err := deleteCheckpoints(sessionID); err != nil {
+			log.Printf("checkpoints of simulation %s: %v", sessionID, err)
+		}
+	}
+}
+
+// enqueue hands a checkpoint to the writer without waiting. It is skipped
+// when the writer is behind; the next one will catch up.
+func (c *checkpointer) enqueue(sessionID string, snapshot sessionSnapshot) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.forgotten[sessionID] {
+		return
+	}
+	select {
+	case c.queue <- checkpoint{sessionID: sessionID, snapshot: snapshot}:
+	default:
+		log.Printf("checkpoint of simulation %s skipped: writer is busy", sessionID)
+	}
+}
+
+// forget deletes the checkpoints of a removed session, without waiting for
+// the writer. Those still queued are dropped.
+func (c *checkpointer) forget(sessionID string) {
+	c.mu.Lock()
+	c.forgotten[sessionID] = true
+	if !c.closed {
+		c.forgets = append(c.forgets, sessionID)
+	}
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close checkpoints every session a last time, then waits for the writer
+// to finish.
+func (c *checkpointer) close(sessions []*session) {
+	// Once closed, nothing but this call sends on the queue
+	c.mu.Lock()
+	closed := c.closed
+	c.closed = true
+	c.mu.Unlock()
+	if closed {
+		<-c.done
+		return
+	}
+	for _, s := range sessions {
+		snapshot, err := s.Snapshot()
+		if err != nil {
+			continue
+		}
+		c.queue <- checkpoint{sessionID: s.ID, snapshot: snapshot}
+	}
+	close(c.queue)
+	<-c.done
+}
+
+// resume restores the latest checkpoint of a session, and starts it again if
+// it was running. It reports whether there was a checkpoint.
+func resume(s *session) (bool, error) {
+	id, err := latestCheckpoint(s.ID)
+	if err == errSaveNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	saved, err := restoreSave(s, id)
+	if err != nil {
+		return false, err
+	}
+	log.Printf("simulation %s resumed from checkpoint %d at tick %d", s.ID, id, saved.Tick)
+	if saved.State.IsRunning {
+		return true, s.StartSimulation()
+	}
+	return true, nil
+}
+
+// forgetCheckpoints deletes the checkpoints of a removed session.
+func forgetCheckpoints(sessionID string) {
+	if checkpoints != nil {
+		checkpoints.forget(sessionID)
+	} else if err := deleteCheckpoints(sessionID); err != nil {
+		log.Printf("checkpoints of simulation %s: %v", sessionID, err)
+	}
+}
+
+// resumeSessions recreates every session with checkpoints, with config and
+// env until its checkpoint is restored, and resumes it.
+func resumeSessions(config engine.SimulationConfig, env engine.EnvironmentalFactors) error {
+	ids, err := savedSessions(true)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		s, ok := sessions.get(id)
+		if !ok {
+			s = sessions.create(id, config, env)
+		}
+		if _, err := resume(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,549 @@
+package engine
+
+import (
+	"math"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// resourceClaim records a unit of resource a bird takes while deciding,
+// granted once every bird has decided.
+type resourceClaim struct {
+	index    int  // Index in Resources, -1 for none
+	relocate bool // Move and refill the resource when it runs out
+	eat      bool // The bird feeds on the unit
+}
+
+var noClaim = resourceClaim{index: -1}
+
+// update advances birds and predators by one tick in two phases. While
+// sensing and deciding, every bird reads the world as it was at the start of
+// the tick and only writes its own next record, so birds are processed in
+// parallel. The resulting records and their side effects on resources are
+// then committed in bird order. Random draws made for a bird come from its
+// own stream, which makes the result independent of the number of workers.
+func (s *Simulation) update() {
+	s.prepareIndexes()
+	prev := s.state.Birds
+	neighbours := s.indexBirds()
+	next := make([]Bird, len(prev))
+	workers := s.workers()
+
+	// Sense: adjust bird behavior based on environmental factors and the
+	// calendar
+	daytime, migrationSeason, role := s.state.Daytime, s.migrationSeason(), s.seasonalRole()
+	seasonPhase := s.seasonPhase()
+	parallelFor(len(prev), workers, func(i int) {
+		bird := &next[i]
+		*bird = prev[i]
+		bird.Age++
+		bird.Juvenile = bird.Age < s.maturityAge()
+		// Conditions vary continuously over the world; only the role of the
+		// land comes from the closest zone
+		here := s.conditionsAt(prev[i].Position)
+		zone := s.findClosestZone(prev[i].Position)
+		genome := prev[i].Genome
+		if here.Temperature < genome.PreferredTemperature-s.speciesOf(&prev[i]).TemperatureTolerance {
+			bird.State = "migrating"
+		} else if here.FoodAvailability < 0.5 {
+			bird.State = "searchingFood"
+		} else if here.PredatorPresence > 1-genome.RiskAversion {
+			// Risk averse birds hide sooner
+			bird.State = "resting"
+		}
+		// In spring and autumn birds leave for their seasonal zones when
+		// their migration timing says so, once they have fed and rested
+		if migrationSeason && seasonPhase >= genome.departure() && zone.Role != role && !hungry(bird) && !tired(bird) {
+			if _, ok := s.seasonalZone(bird.Position); ok {
+				bird.State = "migrating"
+			}
+		}
+		// Birds do not forage at night, nor fly but to migrate
+		if !daytime && (bird.State == "searchingFood" || bird.State == "migrating" && !migrationSeason) {
+			bird.State = "resting"
+		}
+	})
+
+	// Migrating birds head for the centre of the migrating birds of their group
+	groupTargets := s.migratingGroupTargets(next)
+
+	// Decide
+	claims := make([]resourceClaim, len(prev))
+	parallelFor(len(prev), workers, func(i int) {
+		bird := &next[i]
+		rng := newAgentRand(s.seed, s.state.Time, bird.ID, saltDecide)
+		claims[i] = noClaim
+		if bird.State == "migrating" {
+			s.decideMigrating(bird, prev, i, neighbours, groupTargets[bird.Group])
+		} else if bird.State == "resting" {
+			claims[i] = s.decideResting(bird, rng)
+		} else if bird.State == "searchingFood" {
+			claims[i] = s.decideSearchingFood(bird, rng)
+		}
+	})
+
+	// Act
+	s.state.Birds = next
+	s.detectStrikes(prev)
+	s.detectEmigration()
+	s.applyClaims(claims)
+	s.checkHealth()
+
+	// Check if the current food location is depleted
+	if len(s.state.Resources) == 0 || s.state.Resources[0].Current <= 0 {
+		s.relocateFood()
+	}
+
+	// Index the birds where they ended up this tick; predators and collision
+	// detection only look at their neighbourhood
+	birds := s.indexBirds()
+	s.computeGroupCentroids()
+
+	// Predators hunt the birds where they ended up
+	s.updatePredators(birds)
+
+	s.state.Time++
+	s.updateCalendar()
+}
+
+// relocateFood generates a new food location in the best zone and sends all
+// the birds towards it. Without zones there is nowhere to move it to.
+func (s *Simulation) relocateFood() {
+	bestZone, ok := s.findBestZone()
+	if !ok {
+		return
+	}
+	s.currentFoodLocation = s.generateFoodLocation(bestZone.ID)
+	s.placeFood()
+
+	// Update all birds to move towards the new food location
+	for i := range s.state.Birds {
+		bird := &s.state.Birds[i]
+		if bird.State == "dead" {
+			continue
+		}
+		bird.State = "migrating"
+		bird.Target = s.currentFoodLocation
+	}
+}
+
+// decideMigrating, decideResting and decideSearchingFood compute the next
+// record of a bird. They may run concurrently: they only write to bird and
+// report resource consumption as a claim.
+func (s *Simulation) decideMigrating(bird *Bird, prev []Bird, i int, neighbours *spatialIndex, groupTarget [2]float64) {
+	// Fly with the flock towards the group target, taking the cheapest way
+	// over the terrain and around the structures ahead. Birds cruise at full
+	// speed: steering turns them, it does not slow them down.
+	from := *bird
+	force := s.flock(prev, i, neighbours, groupTarget)
+	heading := normalize([2]float64{bird.Velocity[0] + force[0], bird.Velocity[1] + force[1]})
+	speed := s.cruiseSpeed(bird)
+	heading = s.route(bird, heading, speed)
+	bird.Velocity = [2]float64{heading[0] * speed, heading[1] * speed}
+	s.fly(bird, cruiseClearance)
+	s.spendFlight(bird, &from)
+
+	// Hunger comes before fatigue
+	if hungry(bird) {
+		bird.State = "searchingFood"
+	} else if tired(bird) {
+		bird.State = "resting"
+	}
+}
+
+func (s *Simulation) decideResting(bird *Bird, rng randSource) resourceClaim {
+	claim := noClaim
+	// Birds do not forage at night
+	if hungry(bird) && s.state.Daytime {
+		bird.State = "searchingFood"
+		return claim
+	}
+
+	// Fly to a nearby rest site if there is one, otherwise rest on the spot
+	site, index := s.findClosestResource(bird.Position, "rest")
+	if site != nil && site.Current <= 0 {
+		site = nil
+	}
+	atSite := site != nil && s.dist(bird.Position, site.Position) < reachDistance
+	if site != nil && !atSite && s.dist(bird.Position, site.Position) < restSiteRange {
+		from := *bird
+		s.flyTowards(bird, site.Position)
+		s.spendFlight(bird, &from)
+		return claim
+	}
+
+	// Perch on the ground
+	bird.Velocity = [2]float64{}
+	bird.Altitude = s.groundLevel(bird.Position)
+	s.spendBasal(bird)
+	recovery := restRecovery * float64(s.timeStep)
+	if atSite {
+		// Rest sites are sheltered: rest is quicker and birds can feed a little
+		recovery *= 2
+		bird.Energy = math.Min(maxEnergy, bird.Energy+restSiteEnergy*float64(s.timeStep))
+	}
+	bird.Fatigue = math.Max(0, bird.Fatigue-recovery)
+
+	// Take off once rested, at night only to migrate
+	if bird.Fatigue <= restedFatigue && (s.state.Daytime || s.migrationSeason() && !hungry(bird)) {
+		bird.State = "migrating"
+		if atSite {
+			claim = resourceClaim{index: index, relocate: true}
+		}
+		// Set a new target within a small circle
+		angle := rng.Float64() * 2 * math.Pi
+		radius := rng.Float64() * 10
+		bird.Target = [2]float64{
+			bird.Position[0] + radius*math.Cos(angle),
+			bird.Position[1] + radius*math.Sin(angle),
+		}
+	}
+	return claim
+}
+
+func (s *Simulation) decideSearchingFood(bird *Bird, rng randSource) resourceClaim {
+	closestResource, index := s.findClosestFood(bird.Position, s.speciesOf(bird))
+	if closestResource == nil || closestResource.Current <= 0 {
+		// If no food is available nearby, move to a random location to search for food
+		bird.Target = s.randomPositionFrom(rng)
+		s.spendBasal(bird)
+		return noClaim
+	}
+	from := *bird
+	s.flyTowards(bird, closestResource.Position)
+	s.spendFlight(bird, &from)
+
+	if s.dist(bird.Position, closestResource.Position) >= reachDistance {
+		return noClaim
+	}
+	// Eat one unit of food per tick until sated
+	return resourceClaim{index: index, relocate: true, eat: true}
+}
+
+// eat feeds bird a unit of food and lets it leave once sated.
+func (s *Simulation) eat(bird *Bird) {
+	bird.Energy = math.Min(maxEnergy, bird.Energy+foodEnergy)
+	if bird.Energy >= bird.Genome.satedEnergy() {
+		if tired(bird) {
+			bird.State = "resting"
+		} else {
+			bird.State = "migrating"
+			bird.Target = s.randomPositionFrom(newAgentRand(s.seed, s.state.Time, bird.ID, saltEat))
+		}
+	}
+}
+
+// flyTowards moves bird towards target at the speed of its genome, around
+// the terrain and structures it cannot fly over, descending to land as it
+// gets closer.
+func (s *Simulation) flyTowards(bird *Bird, target [2]float64) {
+	direction := s.offset(bird.Position, target)
+	normalizedDirection := s.route(bird, normalize(direction), bird.Genome.Speed)
+	bird.Velocity = [2]float64{normalizedDirection[0] * bird.Genome.Speed, normalizedDirection[1] * bird.Genome.Speed}
+	s.fly(bird, math.Min(cruiseClearance, s.dist(bird.Position, target)))
+}
+
+// fly moves bird along its velocity for one time step, drifting with the
+// wind, and climbs or descends towards clearance above the ground. Birds that
+// fly out of an open world are left outside; they emigrate once every bird
+// has moved.
+func (s *Simulation) fly(bird *Bird, clearance float64) {
+	bird.Velocity = s.repel(bird.Position, bird.Velocity)
+	wind := s.windAt(bird.Position)
+	bird.Position[0] += (bird.Velocity[0] + wind[0]) * float64(s.timeStep)
+	bird.Position[1] += (bird.Velocity[1] + wind[1]) * float64(s.timeStep)
+	s.confine(&bird.Position, &bird.Velocity)
+	s.climb(bird, clearance)
+}
+
+// applyClaims grants the claims of birds on resources, resource by resource.
+// When birds claim more units than a resource has left, the ones that get a
+// unit are drawn at random: birds, of the same species or not, compete for
+// the resources they share.
+func (s *Simulation) applyClaims(claims []resourceClaim) {
+	claimants := make(map[int][]int)
+	for i, claim := range claims {
+		if claim.index >= 0 && claim.index < len(s.state.Resources) {
+			claimants[claim.index] = append(claimants[claim.index], i)
+		}
+	}
+	indexes := make([]int, 0, len(claimants))
+	for index := range claimants {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	for _, index := range indexes {
+		resource := &s.state.Resources[index]
+		birds := claimants[index]
+		if available := max(resource.Current, 0); len(birds) > available {
+			s.rng.Shuffle(len(birds), func(a, b int) { birds[a], birds[b] = birds[b], birds[a] })
+			birds = birds[:available]
+			sort.Ints(birds)
+		}
+
+		relocate := false
+		for _, i := range birds {
+			resource.Current--
+			relocate = relocate || claims[i].relocate
+			if claims[i].eat {
+				s.eat(&s.state.Birds[i])
+			}
+		}
+		if relocate && resource.Current <= 0 {
+			// Move the resource to a new location if it is depleted
+			resource.Position = s.randomPosition()
+			resource.Current = resource.Capacity
+			s.resourceIndex = nil
+		}
+	}
+}
+
+// workers returns the number of goroutines birds are updated on.
+func (s *Simulation) workers() int {
+	if s.config.Workers > 0 {
+		return s.config.Workers
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// parallelFor calls fn for every i in [0, n), splitting the range in
+// contiguous chunks over the given number of workers.
+func parallelFor(n, workers int, fn func(i int)) {
+	if workers <= 1 || n < minParallelItems {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	chunk := (n + workers - 1) / workers
+	for lo := 0; lo < n; lo += chunk {
+		hi := min(lo+chunk, n)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := lo; i < hi; i++ {
+				fn(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// detectCollisions counts each pair of birds closer than collisionThreshold
+// once, when they first touch, and pushes them apart. A bird's CollisionTime
+// is cleared once it no longer touches any other bird.
+func (s *Simulation) detectCollisions() {
+	birds := s.birdIndex
+	if birds == nil {
+		birds = s.indexBirds()
+	}
+	touching := make([]bool, len(s.state.Birds))
+	for i := range s.state.Birds {
+		bird1 := &s.state.Birds[i]
+		birds.query(bird1.Position, collisionThreshold, func(j int) {
+			if j <= i {
+				return
+			}
+			bird2 := &s.state.Birds[j]
+			if bird1.State == "dead" || bird2.State == "dead" || s.dist(bird1.Position, bird2.Position) >= collisionThreshold ||
+				math.Abs(bird1.Altitude-bird2.Altitude) >= collisionThreshold {
+				return
+			}
+			touching[i], touching[j] = true, true
+			if bird1.CollisionTime == 0 && bird2.CollisionTime == 0 {
+				bird1.CollisionTime = int64(s.state.Time)
+				bird2.CollisionTime = int64(s.state.Time)
+				s.state.CollisionCount++
+				// Move birds apart to reduce further collisions, but not
+				// through a structure nor out of the world
+				before := [2][2]float64{bird1.Position, bird2.Position}
+				moveBirdsApart(bird1, bird2, s.offset(bird2.Position, bird1.Position))
+				for k, bird := range []*Bird{bird1, bird2} {
+					if _, hit := s.castRay(before[k], bird.Position, bird.Altitude); hit {
+						bird.Position = before[k]
+					}
+					bird.Position = s.keepInside(bird.Position)
+				}
+				for _, bird := range []*Bird{bird1, bird2} {
+					if s.config.CollisionMortality > 0 && s.rng.Float64() < s.config.CollisionMortality {
+						s.kill(bird, collided)
+					}
+				}
+			}
+		})
+	}
+	for i := range s.state.Birds {
+		if !touching[i] {
+			s.state.Birds[i].CollisionTime = 0
+		}
+	}
+	s.birdIndex = nil
+}
+
+// moveBirdsApart pushes two birds away from each other along direction,
+// from bird2 to bird1.
+func moveBirdsApart(bird1, bird2 *Bird, direction [2]float64) {
+	normalizedDirection := normalize(direction)
+	bird1.Position[0] += normalizedDirection[0] * collisionThreshold
+	bird1.Position[1] += normalizedDirection[1] * collisionThreshold
+	bird2.Position[0] -= normalizedDirection[0] * collisionThreshold
+	bird2.Position[1] -= normalizedDirection[1] * collisionThreshold
+}
+
+// prepareIndexes builds the resource and zone indexes and the environmental
+// layers if they are stale, so that concurrent lookups only read them.
+func (s *Simulation) prepareIndexes() {
+	if s.resourceIndex == nil {
+		points := make([][2]float64, len(s.state.Resources))
+		for i, res := range s.state.Resources {
+			points[i] = res.Position
+		}
+		s.resourceIndex = newSpatialIndex(points, float64(s.config.WorldSize), sparseCellSize(float64(s.config.WorldSize), len(points)), s.period() > 0)
+	}
+	if s.zoneIndex == nil {
+		points := make([][2]float64, len(s.state.Zones))
+		for i, zone := range s.state.Zones {
+			points[i] = zone.Position
+		}
+		s.zoneIndex = newSpatialIndex(points, float64(s.config.WorldSize), sparseCellSize(float64(s.config.WorldSize), len(points)), s.period() > 0)
+	}
+	if s.environment == nil {
+		s.environment = s.buildEnvironment()
+	}
+	if s.terrain == nil {
+		s.terrain = s.buildTerrain()
+	}
+	if s.ground == nil {
+		s.ground = s.buildGround()
+	}
+}
+
+func (s *Simulation) findClosestResource(pos [2]float64, resourceType string) (*Resource, int) {
+	return s.closestResource(pos, func(r *Resource) bool { return r.Type == resourceType })
+}
+
+// findClosestFood returns the closest resource in the diet of species.
+func (s *Simulation) findClosestFood(pos [2]float64, species *Species) (*Resource, int) {
+	return s.closestResource(pos, func(r *Resource) bool { return species.eats(r.Type) })
+}
+
+func (s *Simulation) closestResource(pos [2]float64, accept func(r *Resource) bool) (*Resource, int) {
+	s.prepareIndexes()
+	index, _ := s.resourceIndex.nearest(pos, func(i int) bool {
+		return accept(&s.state.Resources[i])
+	})
+	if index < 0 {
+		return nil, -1
+	}
+	// Callers get a copy; updates must go through the index
+	closest := s.state.Resources[index]
+	return &closest, index
+}
+
+// indexBirds builds the spatial index of the current bird positions.
+func (s *Simulation) indexBirds() *spatialIndex {
+	points := make([][2]float64, len(s.state.Birds))
+	for i, bird := range s.state.Birds {
+		points[i] = bird.Position
+	}
+	s.birdIndex = newSpatialIndex(points, float64(s.config.WorldSize), birdIndexCellSize, s.period() > 0)
+	return s.birdIndex
+}
+
+// computeGroupCentroids records the centre of every group of more than one
+// bird, in group order.
+func (s *Simulation) computeGroupCentroids() {
+	groups := make(map[int][]Bird)
+	for _, b := range s.state.Birds {
+		groups[b.Group] = append(groups[b.Group], b)
+	}
+
+	s.groupCentroids = s.groupCentroids[:0]
+	for _, id := range sortedGroupIDs(groups) {
+		group := groups[id]
+		if len(group) > 1 {
+			centre := s.newCentroid()
+			for _, b := range group {
+				centre.add(b.Position)
+			}
+			s.groupCentroids = append(s.groupCentroids, centre.mean())
+		}
+	}
+}
+
+func (s *Simulation) findClosestGroup(bird *Bird) [2]float64 {
+	var closestGroupPos [2]float64
+	minDist := math.MaxFloat64
+	for _, groupPos := range s.groupCentroids {
+		dist := s.dist(bird.Position, groupPos)
+		if dist < minDist {
+			minDist = dist
+			closestGroupPos = groupPos
+		}
+	}
+	return closestGroupPos
+}
+
+func (s *Simulation) findClosestZone(pos [2]float64) Zone {
+	s.prepareIndexes()
+	index, _ := s.zoneIndex.nearest(pos, func(int) bool { return true })
+	if index < 0 {
+		return Zone{}
+	}
+	return s.state.Zones[index]
+}
+
+// migratingGroupTargets returns, for every group, the closest zone of the
+// season if the group has not reached it yet, otherwise the centre of its
+// migrating birds, or a random point when none of them is migrating. Groups
+// are visited in a fixed order so that random draws are reproducible.
+func (s *Simulation) migratingGroupTargets(birds []Bird) map[int][2]float64 {
+	sums := make(map[int]*centroid)
+	for _, bird := range birds {
+		total, ok := sums[bird.Group]
+		if !ok {
+			centre := s.newCentroid()
+			total = &centre
+			sums[bird.Group] = total
+		}
+		if bird.State == "migrating" {
+			total.add(bird.Position)
+		}
+	}
+
+	ids := make([]int, 0, len(sums))
+	for id := range sums {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	targets := make(map[int][2]float64, len(sums))
+	for _, id := range ids {
+		total := sums[id]
+		if total.n > 0 {
+			centre := total.mean()
+			// Groups head for the closest zone of the season until they get
+			// there
+			if zone, ok := s.seasonalZone(centre); ok && s.dist(centre, zone.Position) > zoneArrivalRadius {
+				centre = zone.Position
+			}
+			targets[id] = centre
+		} else {
+			targets[id] = s.randomPosition()
+		}
+	}
+	return targets
+}
+
+func sortedGroupIDs(groups map[int][]Bird) []int {
+	ids := make([]int, 0, len(groups))
+	for id := range groups {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
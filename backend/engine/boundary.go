@@ -0,0 +1,158 @@
+package engine
+
+import "math"
+
+const (
+	boundaryMargin = 50.0 // Width of the margins birds are pushed back from
+	edgeRepulsion  = 1.0  // Push at the edge of the world, distance per tick
+)
+
+// Boundaries of the world
+const (
+	clampBoundary   = "clamp"   // Bodies stop at the edges
+	reflectBoundary = "reflect" // Bodies bounce off the edges
+	torusBoundary   = "torus"   // Opposite edges meet
+	softBoundary    = "soft"    // Birds are turned back within a margin of the edges
+	openBoundary    = "open"    // Birds that fly out emigrate
+)
+
+// boundary returns the boundary of the world.
+func (s *Simulation) boundary() string {
+	switch s.config.Boundary {
+	case reflectBoundary, torusBoundary, softBoundary, openBoundary:
+		return s.config.Boundary
+	default:
+		return clampBoundary
+	}
+}
+
+// period returns the size of the world if it wraps around, zero otherwise.
+func (s *Simulation) period() float64 {
+	if s.boundary() == torusBoundary {
+		return float64(s.config.WorldSize)
+	}
+	return 0
+}
+
+// offset returns the vector from one point to another, the shortest way
+// around on a torus.
+func (s *Simulation) offset(from, to [2]float64) [2]float64 {
+	return wrappedOffset(from, to, s.period())
+}
+
+// dist returns the distance between two points, the shortest way around on
+// a torus.
+func (s *Simulation) dist(a, b [2]float64) float64 {
+	offset := s.offset(a, b)
+	return math.Hypot(offset[0], offset[1])
+}
+
+// keepInside returns pos brought back into the world: wrapped around a
+// torus, stopped at the edges otherwise.
+func (s *Simulation) keepInside(pos [2]float64) [2]float64 {
+	worldSize := float64(s.config.WorldSize)
+	for axis := 0; axis < 2; axis++ {
+		if s.boundary() == torusBoundary {
+			pos[axis] = math.Mod(pos[axis], worldSize)
+			if pos[axis] < 0 {
+				pos[axis] += worldSize
+			}
+		} else {
+			pos[axis] = math.Max(0, math.Min(worldSize, pos[axis]))
+		}
+	}
+	return pos
+}
+
+// confine applies the boundary of the world to a body that moved to pos at
+// velocity vel. A body that left an open world is left outside, for
+// detectEmigration to find.
+func (s *Simulation) confine(pos, vel *[2]float64) {
+	worldSize := float64(s.config.WorldSize)
+	switch s.boundary() {
+	case openBoundary:
+		return
+	case reflectBoundary:
+		for axis := 0; axis < 2; axis++ {
+			if pos[axis] < 0 {
+				pos[axis], vel[axis] = -pos[axis], math.Abs(vel[axis])
+			} else if pos[axis] > worldSize {
+				pos[axis], vel[axis] = 2*worldSize-pos[axis], -math.Abs(vel[axis])
+			}
+		}
+	}
+	*pos = s.keepInside(*pos)
+}
+
+// repel turns vel back from the edges of the world when pos lies within
+// their margin, the harder the closer to the edge. It leaves vel unchanged
+// but with soft boundaries.
+func (s *Simulation) repel(pos, vel [2]float64) [2]float64 {
+	if s.boundary() != softBoundary {
+		return vel
+	}
+	worldSize := float64(s.config.WorldSize)
+	margin := math.Min(boundaryMargin, worldSize/4)
+	for axis := 0; axis < 2; axis++ {
+		if pos[axis] < margin {
+			vel[axis] += edgeRepulsion * (1 - pos[axis]/margin)
+		} else if pos[axis] > worldSize-margin {
+			vel[axis] -= edgeRepulsion * (1 - (worldSize-pos[axis])/margin)
+		}
+	}
+	return vel
+}
+
+// detectEmigration removes from the population the birds that flew out of
+// an open world.
+func (s *Simulation) detectEmigration() {
+	if s.boundary() != openBoundary {
+		return
+	}
+	worldSize := float64(s.config.WorldSize)
+	for i := range s.state.Birds {
+		bird := &s.state.Birds[i]
+		if bird.Position[0] < 0 || bird.Position[0] > worldSize || bird.Position[1] < 0 || bird.Position[1] > worldSize {
+			s.kill(bird, emigrated)
+		}
+	}
+}
+
+// centroid accumulates positions and returns their mean. On a torus the
+// coordinates are averaged as angles around it, so that a group straddling
+// an edge is centred on the edge rather than across the world.
+type centroid struct {
+	period   float64
+	sum      [2]float64
+	cos, sin [2]float64
+	n        int
+}
+
+func (s *Simulation) newCentroid() centroid {
+	return centroid{period: s.period()}
+}
+
+func (c *centroid) add(pos [2]float64) {
+	for axis := 0; axis < 2; axis++ {
+		c.sum[axis] += pos[axis]
+		if c.period > 0 {
+			angle := 2 * math.Pi * pos[axis] / c.period
+			c.cos[axis] += math.Cos(angle)
+			c.sin[axis] += math.Sin(angle)
+		}
+	}
+	c.n++
+}
+
+func (c *centroid) mean() [2]float64 {
+	var mean [2]float64
+	for axis := 0; axis < 2; axis++ {
+		if c.period > 0 {
+			angle := math.Atan2(c.sin[axis], c.cos[axis])
+			mean[axis] = math.Mod(angle/(2*math.Pi)*c.period+c.period, c.period)
+		} else {
+			mean[axis] = c.sum[axis] / float64(c.n)
+		}
+	}
+	return mean
+}
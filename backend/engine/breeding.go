@@ -0,0 +1,128 @@
+package engine
+
+import "math"
+
+const (
+	defaultYearLength = 3600 // Ticks per simulated year
+
+	pairDistance     = 20.0 // Partners must be this close to breed
+	breedingEnergy   = 50.0 // Energy both partners need to breed
+	clutchEnergyCost = 20.0 // Energy each partner spends on a clutch
+	maxClutchSize    = 3
+	hatchlingEnergy  = 60.0
+	hatchlingSpread  = 5.0 // Hatchlings appear this close to their parents
+	capacityPerBird  = 4   // Default carrying capacity, per initial bird
+)
+
+// yearLength returns the number of ticks in a simulated year.
+func (s *Simulation) yearLength() int {
+	if s.config.YearLength > 0 {
+		return s.config.YearLength
+	}
+	return defaultYearLength
+}
+
+// Birds become adults after half a year and may die of old age after
+// three years, on average one year later.
+func (s *Simulation) maturityAge() int   { return s.yearLength() / 2 }
+func (s *Simulation) senescenceAge() int { return 3 * s.yearLength() }
+
+// breedingSeason reports whether birds breed on the current tick: in
+// summer, once they have flown to their breeding zones.
+func (s *Simulation) breedingSeason() bool {
+	return s.season() == "summer"
+}
+
+func (s *Simulation) carryingCapacity() int {
+	if s.config.CarryingCapacity > 0 {
+		return s.config.CarryingCapacity
+	}
+	return capacityPerBird * s.config.InitialBirds
+}
+
+// suitableForBreeding reports whether pos is mild in the current season, has
+// food and few predators. Birds do not breed in wintering zones.
+func (s *Simulation) suitableForBreeding(pos [2]float64) bool {
+	here := s.conditionsAt(pos)
+	return s.findClosestZone(pos).Role != "wintering" && here.Temperature > 10.0 && here.Temperature < 25.0 && here.FoodAvailability >= 0.5 && here.PredatorPresence < 0.5
+}
+
+// canBreed reports whether bird may look for a partner this year.
+func (s *Simulation) canBreed(bird *Bird, year int) bool {
+	return bird.State != "dead" && !bird.Juvenile && bird.LastBreedingYear < year &&
+		bird.Energy >= breedingEnergy && s.suitableForBreeding(bird.Position)
+}
+
+// breed pairs the adults of a group and species that meet in a suitable zone during the
+// breeding season. Every pair lays a clutch of juveniles once a year, until
+// the population reaches the carrying capacity. Birds are paired in order,
+// each with its closest free partner.
+func (s *Simulation) breed() {
+	if !s.breedingSeason() || len(s.state.Birds) >= s.carryingCapacity() {
+		return
+	}
+	year := s.state.Time / s.yearLength()
+	birds := s.indexBirds()
+	count := len(s.state.Birds)
+	for i := 0; i < count; i++ {
+		bird := &s.state.Birds[i]
+		if !s.canBreed(bird, year) {
+			continue
+		}
+		partner, partnerDist := -1, math.MaxFloat64
+		birds.query(bird.Position, pairDistance, func(j int) {
+			other := &s.state.Birds[j]
+			if j == i || other.Group != bird.Group || other.Species != bird.Species || !s.canBreed(other, year) {
+				return
+			}
+			if dist := s.dist(bird.Position, other.Position); dist < partnerDist {
+				partner, partnerDist = j, dist
+			}
+		})
+		if partner < 0 {
+			continue
+		}
+
+		mate := &s.state.Birds[partner]
+		for _, parent := range []*Bird{bird, mate} {
+			parent.LastBreedingYear = year
+			parent.Energy -= clutchEnergyCost
+		}
+		clutch := 1 + s.rng.Intn(maxClutchSize)
+		for k := 0; k < clutch && len(s.state.Birds) < s.carryingCapacity(); k++ {
+			s.state.Birds = append(s.state.Birds, s.hatch(bird, mate))
+			// Appending may have moved the parents
+			bird, mate = &s.state.Birds[i], &s.state.Birds[partner]
+		}
+	}
+	s.birdIndex = nil
+	s.countPopulation()
+}
+
+// hatch returns a juvenile of the two parents, next to them.
+func (s *Simulation) hatch(parent1, parent2 *Bird) Bird {
+	angle := s.rng.Float64() * 2 * math.Pi
+	between := s.offset(parent1.Position, parent2.Position)
+	position := s.keepInside([2]float64{
+		parent1.Position[0] + between[0]/2 + hatchlingSpread*math.Cos(angle),
+		parent1.Position[1] + between[1]/2 + hatchlingSpread*math.Sin(angle),
+	})
+
+	chick := Bird{
+		ID:               s.nextBirdID,
+		Position:         position,
+		Altitude:         s.groundLevel(position),
+		State:            "resting",
+		Target:           position,
+		Group:            parent1.Group,
+		Species:          parent1.Species,
+		Energy:           hatchlingEnergy,
+		Juvenile:         true,
+		Generation:       max(parent1.Generation, parent2.Generation) + 1,
+		LastBreedingYear: -1,
+		Genome:           s.inherit(&parent1.Genome, &parent2.Genome),
+	}
+	s.nextBirdID++
+	s.state.Population.Born++
+	return chick
+}
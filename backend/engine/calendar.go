@@ -0,0 +1,101 @@
+package engine
+
+import "math"
+
+const (
+	defaultDayLength  = 100   // Ticks per day
+	midsummer         = 0.375 // Share of the year elapsed at midsummer
+	daylightSwing     = 0.15  // Share of the day by which days lengthen in summer
+	zoneArrivalRadius = 100.0 // A group closer than this to its seasonal zone has arrived
+	departureWindow   = 0.25  // Share of a migration season over which birds depart
+)
+
+// Seasons split the year in quarters, starting with spring.
+var seasons = [4]string{"spring", "summer", "autumn", "winter"}
+
+// dayLength returns the number of ticks in a day.
+func (s *Simulation) dayLength() int {
+	if s.config.DayLength > 0 {
+		return s.config.DayLength
+	}
+	return defaultDayLength
+}
+
+// yearPhase returns the share of the year elapsed, in [0, 1).
+func (s *Simulation) yearPhase() float64 {
+	return float64(s.state.Time%s.yearLength()) / float64(s.yearLength())
+}
+
+// seasonPhase returns the share of the current season elapsed, in [0, 1).
+func (s *Simulation) seasonPhase() float64 {
+	phase := s.yearPhase() * 4
+	return phase - math.Floor(phase)
+}
+
+// season returns the season of the current tick.
+func (s *Simulation) season() string {
+	return seasons[min(int(s.yearPhase()*4), 3)]
+}
+
+// daytime reports whether the current tick falls in daylight. Days are
+// longer in summer and shorter in winter.
+func (s *Simulation) daytime() bool {
+	daylight := 0.5 + daylightSwing*s.seasonalFactor()
+	return float64(s.state.Time%s.dayLength()) < daylight*float64(s.dayLength())
+}
+
+// updateCalendar sets the year, day and season of the state from its time.
+func (s *Simulation) updateCalendar() {
+	s.state.Year = s.state.Time / s.yearLength()
+	s.state.Day = s.state.Time % s.yearLength() / s.dayLength()
+	s.state.Season = s.season()
+	s.state.Daytime = s.daytime()
+}
+
+// seasonalFactor goes from 1 at midsummer to -1 at midwinter. Temperatures
+// swing by their seasonal amplitude times this factor.
+func (s *Simulation) seasonalFactor() float64 {
+	return math.Cos(2 * math.Pi * (s.yearPhase() - midsummer))
+}
+
+// zoneTemperature returns the temperature of zone in the current season,
+// shifted by the global temperature.
+func (s *Simulation) zoneTemperature(zone Zone) float64 {
+	return zone.Temperature + zone.SeasonalAmplitude*s.seasonalFactor() + s.temperatureShift()
+}
+
+// seasonalRole returns the role of the zones birds should be in during the
+// current season: breeding zones in spring and summer, wintering zones in
+// autumn and winter.
+func (s *Simulation) seasonalRole() string {
+	switch s.season() {
+	case "spring", "summer":
+		return "breeding"
+	default:
+		return "wintering"
+	}
+}
+
+// migrationSeason reports whether birds are on their way to their seasonal
+// zones: to breed in spring, to winter in autumn.
+func (s *Simulation) migrationSeason() bool {
+	season := s.season()
+	return season == "spring" || season == "autumn"
+}
+
+// seasonalZone returns the closest zone to pos with the seasonal role, or
+// false if there is none.
+func (s *Simulation) seasonalZone(pos [2]float64) (Zone, bool) {
+	role := s.seasonalRole()
+	var best Zone
+	found, bestDist := false, math.MaxFloat64
+	for _, zone := range s.state.Zones {
+		if zone.Role != role {
+			continue
+		}
+		if dist := s.dist(pos, zone.Position); dist < bestDist {
+			best, bestDist, found = zone, dist, true
+		}
+	}
+	return best, found
+}
@@ -0,0 +1,260 @@
+package engine
+
+import "slices"
+
+// Delta describes how a SimulationState changed between two ticks. Entities
+// are matched by ID. Scalar fields always carry the new values; collections
+// only list what changed.
+type Delta struct {
+	Time           int        `json:"time"`
+	IsRunning      bool       `json:"isRunning"`
+	WorldSize      int        `json:"worldSize"`
+	CollisionCount int        `json:"collisionCount"`
+	StrikeCount    int        `json:"strikeCount"`
+	Seed           int64      `json:"seed"`
+	Population     Population `json:"population"`
+	Year           int        `json:"year"`
+	Day            int        `json:"day"`
+	Season         string     `json:"season"`
+	Daytime        bool       `json:"daytime"`
+
+	MovedBirds   []BirdMove `json:"movedBirds,omitempty"`   // Birds whose position, altitude, velocity, state, energy, fatigue or age changed
+	Birds        []Bird     `json:"birds,omitempty"`        // Spawned birds and birds with any other change
+	RemovedBirds []int      `json:"removedBirds,omitempty"` // IDs
+
+	ResourceLevels   []ResourceLevel `json:"resourceLevels,omitempty"` // Resources whose Current changed
+	Resources        []Resource      `json:"resources,omitempty"`      // Spawned resources and resources with any other change
+	RemovedResources []int           `json:"removedResources,omitempty"`
+
+	Predators        []Predator `json:"predators,omitempty"`
+	RemovedPredators []int      `json:"removedPredators,omitempty"`
+
+	// Rarely changing collections are resent whole, and only when changed.
+	// A cleared collection is sent as an empty list, never as null.
+	Obstacles        *[]Obstacle        `json:"obstacles,omitempty"`
+	Zones            *[]Zone            `json:"zones,omitempty"`
+	TemperatureZones *[]TemperatureZone `json:"temperatureZones,omitempty"`
+}
+
+// BirdMove is the compact update sent for the fields of a bird that change
+// on almost every tick.
+type BirdMove struct {
+	ID       int        `json:"id"`
+	Position [2]float64 `json:"position"`
+	Altitude float64    `json:"altitude"`
+	Velocity [2]float64 `json:"velocity"`
+	State    string     `json:"state,omitempty"` // Only set when the state changed
+	Energy   float64    `json:"energy"`
+	Fatigue  float64    `json:"fatigue"`
+	Age      int        `json:"age"`
+}
+
+type ResourceLevel struct {
+	ID      int `json:"id"`
+	Current int `json:"current"`
+}
+
+// Diff computes the delta that turns prev into next.
+func Diff(prev, next SimulationState) Delta {
+	d := Delta{
+		Time:           next.Time,
+		IsRunning:      next.IsRunning,
+		WorldSize:      next.WorldSize,
+		CollisionCount: next.CollisionCount,
+		StrikeCount:    next.StrikeCount,
+		Seed:           next.Seed,
+		Population:     next.Population,
+		Year:           next.Year,
+		Day:            next.Day,
+		Season:         next.Season,
+		Daytime:        next.Daytime,
+	}
+
+	prevBirds := indexByID(prev.Birds, func(b Bird) int { return b.ID })
+	for _, bird := range next.Birds {
+		old, ok := prevBirds[bird.ID]
+		delete(prevBirds, bird.ID)
+		switch {
+		case !ok:
+			d.Birds = append(d.Birds, bird)
+		case old == bird:
+		case moved(old, bird):
+			move := BirdMove{ID: bird.ID, Position: bird.Position, Altitude: bird.Altitude, Velocity: bird.Velocity, Energy: bird.Energy, Fatigue: bird.Fatigue, Age: bird.Age}
+			if old.State != bird.State {
+				move.State = bird.State
+			}
+			d.MovedBirds = append(d.MovedBirds, move)
+		default:
+			d.Birds = append(d.Birds, bird)
+		}
+	}
+	d.RemovedBirds = removedIDs(prev.Birds, prevBirds, func(b Bird) int { return b.ID })
+
+	prevResources := indexByID(prev.Resources, func(r Resource) int { return r.ID })
+	for _, resource := range next.Resources {
+		old, ok := prevResources[resource.ID]
+		delete(prevResources, resource.ID)
+		switch {
+		case !ok:
+			d.Resources = append(d.Resources, resource)
+		case old == resource:
+		case levelChanged(old, resource):
+			d.ResourceLevels = append(d.ResourceLevels, ResourceLevel{ID: resource.ID, Current: resource.Current})
+		default:
+			d.Resources = append(d.Resources, resource)
+		}
+	}
+	d.RemovedResources = removedIDs(prev.Resources, prevResources, func(r Resource) int { return r.ID })
+
+	prevPredators := indexByID(prev.Predators, func(p Predator) int { return p.ID })
+	for _, predator := range next.Predators {
+		old, ok := prevPredators[predator.ID]
+		delete(prevPredators, predator.ID)
+		if !ok || old != predator {
+			d.Predators = append(d.Predators, predator)
+		}
+	}
+	d.RemovedPredators = removedIDs(prev.Predators, prevPredators, func(p Predator) int { return p.ID })
+
+	if !slices.EqualFunc(prev.Obstacles, next.Obstacles, Obstacle.equal) {
+		obstacles := cloneObstacles(next.Obstacles)
+		d.Obstacles = &obstacles
+	}
+	if !slices.Equal(prev.Zones, next.Zones) {
+		zones := append([]Zone{}, next.Zones...)
+		d.Zones = &zones
+	}
+	if !slices.Equal(prev.TemperatureZones, next.TemperatureZones) {
+		zones := append([]TemperatureZone{}, next.TemperatureZones...)
+		d.TemperatureZones = &zones
+	}
+	return d
+}
+
+// Apply updates state, the prev argument of Diff, in place so that it holds
+// the same entities as next. New entities are appended in the order they
+// appear in the delta.
+func (d Delta) Apply(state *SimulationState) {
+	state.Time = d.Time
+	state.IsRunning = d.IsRunning
+	state.WorldSize = d.WorldSize
+	state.CollisionCount = d.CollisionCount
+	state.StrikeCount = d.StrikeCount
+	state.Seed = d.Seed
+	state.Population = d.Population
+	state.Year = d.Year
+	state.Day = d.Day
+	state.Season = d.Season
+	state.Daytime = d.Daytime
+
+	state.Birds = removeByID(state.Birds, d.RemovedBirds, func(b Bird) int { return b.ID })
+	birds := positions(state.Birds, func(b Bird) int { return b.ID })
+	for _, move := range d.MovedBirds {
+		if i, ok := birds[move.ID]; ok {
+			state.Birds[i].Position = move.Position
+			state.Birds[i].Altitude = move.Altitude
+			state.Birds[i].Velocity = move.Velocity
+			state.Birds[i].Energy = move.Energy
+			state.Birds[i].Fatigue = move.Fatigue
+			state.Birds[i].Age = move.Age
+			if move.State != "" {
+				state.Birds[i].State = move.State
+			}
+		}
+	}
+	state.Birds = upsertByID(state.Birds, birds, d.Birds, func(b Bird) int { return b.ID })
+
+	state.Resources = removeByID(state.Resources, d.RemovedResources, func(r Resource) int { return r.ID })
+	resources := positions(state.Resources, func(r Resource) int { return r.ID })
+	for _, level := range d.ResourceLevels {
+		if i, ok := resources[level.ID]; ok {
+			state.Resources[i].Current = level.Current
+		}
+	}
+	state.Resources = upsertByID(state.Resources, resources, d.Resources, func(r Resource) int { return r.ID })
+
+	state.Predators = removeByID(state.Predators, d.RemovedPredators, func(p Predator) int { return p.ID })
+	predators := positions(state.Predators, func(p Predator) int { return p.ID })
+	state.Predators = upsertByID(state.Predators, predators, d.Predators, func(p Predator) int { return p.ID })
+
+	if d.Obstacles != nil {
+		state.Obstacles = cloneObstacles(*d.Obstacles)
+	}
+	if d.Zones != nil {
+		state.Zones = slices.Clone(*d.Zones)
+	}
+	if d.TemperatureZones != nil {
+		state.TemperatureZones = slices.Clone(*d.TemperatureZones)
+	}
+}
+
+// moved reports whether the only differences between two records of a bird
+// are the ones carried by a BirdMove.
+func moved(old, bird Bird) bool {
+	old.Position = bird.Position
+	old.Altitude = bird.Altitude
+	old.Velocity = bird.Velocity
+	old.State = bird.State
+	old.Energy = bird.Energy
+	old.Fatigue = bird.Fatigue
+	old.Age = bird.Age
+	return old == bird
+}
+
+func levelChanged(old, resource Resource) bool {
+	old.Current = resource.Current
+	return old == resource
+}
+
+func indexByID[T any](items []T, id func(T) int) map[int]T {
+	index := make(map[int]T, len(items))
+	for _, item := range items {
+		index[id(item)] = item
+	}
+	return index
+}
+
+// removedIDs lists, in their original order, the items still left in remaining.
+func removedIDs[T any](items []T, remaining map[int]T, id func(T) int) []int {
+	if len(remaining) == 0 {
+		return nil
+	}
+	var removed []int
+	for _, item := range items {
+		if _, ok := remaining[id(item)]; ok {
+			removed = append(removed, id(item))
+		}
+	}
+	return removed
+}
+
+func positions[T any](items []T, id func(T) int) map[int]int {
+	index := make(map[int]int, len(items))
+	for i, item := range items {
+		index[id(item)] = i
+	}
+	return index
+}
+
+func removeByID[T any](items []T, ids []int, id func(T) int) []T {
+	if len(ids) == 0 {
+		return items
+	}
+	removed := make(map[int]bool, len(ids))
+	for _, i := range ids {
+		removed[i] = true
+	}
+	return slices.DeleteFunc(items, func(item T) bool { return removed[id(item)] })
+}
+
+func upsertByID[T any](items []T, index map[int]int, updates []T, id func(T) int) []T {
+	for _, item := range updates {
+		if i, ok := index[id(item)]; ok {
+			items[i] = item
+			continue
+		}
+		index[id(item)] = len(items)
+		items = append(items, item)
+	}
+	return items
+}
@@ -0,0 +1,45 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Applying the delta between two ticks to the first gives the second, over
+// a run with births, deaths, and obstacles and zones that change.
+func TestDeltaRoundTrip(t *testing.T) {
+	config := SimulationConfig{WorldSize: 300, InitialBirds: 80, ObstacleCount: 3, ResourceCount: 10, Seed: 5, YearLength: 200, DayLength: 20, CaptureProbability: 0.5}
+	s := New(config, EnvironmentalFactors{Temperature: 20, FoodAvailability: 1, PredatorPresence: 0.6})
+	s.Start()
+
+	births, deaths := 0, 0
+	prev := s.Snapshot()
+	for tick := 0; tick < 400; tick++ {
+		switch tick {
+		case 100:
+			s.state.Obstacles = append(s.state.Obstacles, Obstacle{ID: 99, Shape: polygonShape, Points: [][2]float64{{10, 10}, {40, 10}, {25, 40}}, Height: 20})
+			s.invalidateIndexes()
+		case 200:
+			s.SetZones(s.state.Zones[:1])
+		case 300:
+			s.SetZones(nil)
+			s.state.Obstacles = s.state.Obstacles[:1]
+			s.invalidateIndexes()
+		}
+		s.Step()
+		next := s.Snapshot()
+
+		rebuilt := prev.Clone()
+		Diff(prev, next).Apply(&rebuilt)
+		if !reflect.DeepEqual(rebuilt, next) {
+			t.Fatalf("tick %d: applying the delta did not give the next state", next.Time)
+		}
+		born := next.Population.Born - prev.Population.Born
+		births += born
+		deaths += len(prev.Birds) + born - len(next.Birds)
+		prev = next
+	}
+	if births == 0 || deaths == 0 {
+		t.Fatalf("%d births and %d deaths: the run does not exercise them", births, deaths)
+	}
+}
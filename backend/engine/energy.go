@@ -0,0 +1,49 @@
+package engine
+
+import "math"
+
+// Energy is spent flying and replenished by eating; fatigue builds up flying
+// and wears off resting. Both range from 0 to maxEnergy and the thresholds
+// below drive the transitions between migrating, searchingFood and resting.
+const (
+	maxEnergy     = 100.0
+	hungryEnergy  = 30.0 // Below this a bird looks for food
+	tiredFatigue  = 80.0 // Above this a bird looks for a place to rest
+	restedFatigue = 10.0 // A resting bird takes off again below this
+
+	flightEnergyCost = 0.02  // Energy per unit of distance flown
+	speedEnergyCost  = 0.02  // Extra energy per unit of distance, per unit of speed
+	basalEnergyCost  = 0.005 // Energy per tick, flying or not
+	flightFatigue    = 0.05  // Fatigue per unit of distance flown
+	restRecovery     = 0.5   // Fatigue recovered per tick of rest
+	foodEnergy       = 40.0  // Energy per unit of food eaten
+	restSiteEnergy   = 0.05  // Energy per tick of rest at a rest site
+
+	restSiteRange = 50.0 // Tired birds fly to a rest site closer than this
+	reachDistance = 10.0 // Distance at which a bird eats or perches
+)
+
+// spendFlight charges bird for flying from where it was before, as recorded
+// in from, to where it is. Birds pay for the distance flown through the air,
+// not for the wind drift; faster flight costs more per unit of distance, and
+// so does flying against the wind. Climbing costs energy too.
+func (s *Simulation) spendFlight(bird, from *Bird) {
+	wind := s.windAt(from.Position)
+	drift := float64(s.timeStep)
+	moved := s.offset(from.Position, bird.Position)
+	air := [2]float64{moved[0] - wind[0]*drift, moved[1] - wind[1]*drift}
+	dist := math.Hypot(air[0], air[1])
+	speed := dist / float64(max(s.timeStep, 1))
+	cost := dist * (flightEnergyCost + speedEnergyCost*speed) * windEnergyRatio(air, wind)
+	cost += math.Max(0, bird.Altitude-from.Altitude) * climbEnergyCost
+	bird.Energy = math.Max(0, bird.Energy-cost)
+	bird.Fatigue = math.Min(maxEnergy, bird.Fatigue+dist*flightFatigue)
+}
+
+// spendBasal charges the energy a bird burns on every tick.
+func (s *Simulation) spendBasal(bird *Bird) {
+	bird.Energy = math.Max(0, bird.Energy-basalEnergyCost*float64(s.timeStep))
+}
+
+func hungry(bird *Bird) bool { return bird.Energy < hungryEnergy }
+func tired(bird *Bird) bool  { return bird.Fatigue > tiredFatigue }
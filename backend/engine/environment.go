@@ -0,0 +1,231 @@
+package engine
+
+import "math"
+
+const (
+	defaultEnvironmentResolution = 100  // Cells per side of the layers interpolated from the zones
+	maxEnvironmentResolution     = 1024 // Bounds the memory used by the layers on large settings
+	referenceTemperature         = 20.0 // Global temperature the zones and grids are given for, °C
+)
+
+// EnvironmentGrid holds environmental layers given as rasters of Cols by Rows
+// cells over the world, row by row from the origin. A layer left empty, or
+// of the wrong length, is interpolated from the zones instead.
+type EnvironmentGrid struct {
+	Cols              int       `json:"cols"`
+	Rows              int       `json:"rows"`
+	Temperature       []float64 `json:"temperature,omitempty"`       // Mean over the year, °C
+	SeasonalAmplitude []float64 `json:"seasonalAmplitude,omitempty"` // °C, see Zone
+	FoodAvailability  []float64 `json:"foodAvailability,omitempty"`
+	PredatorPresence  []float64 `json:"predatorPresence,omitempty"`
+}
+
+// Clone returns a copy of the grid that shares no slices with the original.
+func (g *EnvironmentGrid) Clone() *EnvironmentGrid {
+	if g == nil {
+		return nil
+	}
+	clone := *g
+	clone.Temperature = append([]float64(nil), g.Temperature...)
+	clone.SeasonalAmplitude = append([]float64(nil), g.SeasonalAmplitude...)
+	clone.FoodAvailability = append([]float64(nil), g.FoodAvailability...)
+	clone.PredatorPresence = append([]float64(nil), g.PredatorPresence...)
+	return &clone
+}
+
+// conditions are the environmental factors at a point of the world.
+type conditions struct {
+	Temperature      float64
+	FoodAvailability float64
+	PredatorPresence float64
+}
+
+// raster is a layer of values over a grid of cells covering the world,
+// sampled by bilinear interpolation between the cell centres.
+type raster struct {
+	cols, rows int
+	cellW      float64
+	cellH      float64
+	values     []float64
+}
+
+func newRaster(cols, rows int, worldSize float64, values []float64) *raster {
+	return &raster{
+		cols:   cols,
+		rows:   rows,
+		cellW:  worldSize / float64(cols),
+		cellH:  worldSize / float64(rows),
+		values: values,
+	}
+}
+
+// sample returns the value of the layer at pos, holding the edge values
+// beyond the outermost cell centres.
+func (r *raster) sample(pos [2]float64) float64 {
+	x := math.Max(0, math.Min(float64(r.cols-1), pos[0]/r.cellW-0.5))
+	y := math.Max(0, math.Min(float64(r.rows-1), pos[1]/r.cellH-0.5))
+	x0, y0 := int(x), int(y)
+	x1, y1 := min(x0+1, r.cols-1), min(y0+1, r.rows-1)
+	fx, fy := x-float64(x0), y-float64(y0)
+	top := lerp(fx, r.values[y0*r.cols+x0], r.values[y0*r.cols+x1])
+	bottom := lerp(fx, r.values[y1*r.cols+x0], r.values[y1*r.cols+x1])
+	return lerp(fy, top, bottom)
+}
+
+// cell returns the value of the cell pos lies in, holding the edge cells
+// beyond the world. It is cheaper than sample, and coarser.
+func (r *raster) cell(pos [2]float64) float64 {
+	col := clampInt(int(pos[0]/r.cellW), 0, r.cols-1)
+	row := clampInt(int(pos[1]/r.cellH), 0, r.rows-1)
+	return r.values[row*r.cols+col]
+}
+
+// environmentLayers are the rasters birds sense the environment from.
+type environmentLayers struct {
+	temperature       *raster
+	seasonalAmplitude *raster
+	food              *raster
+	predators         *raster
+}
+
+// controlPoint is a point of known environmental values the layers are
+// interpolated from.
+type controlPoint struct {
+	position [2]float64
+	values   [4]float64 // Temperature, seasonal amplitude, food, predators
+}
+
+// buildEnvironment computes the environmental layers. Layers given by the
+// configured grid are used as they are; the others are interpolated, by
+// inverse distance weighting, from the zones. A temperature zone sets the
+// mean temperature of the zones in its region, or stands for one at the
+// centre of a region without any. Without any zone the layers are uniform,
+// so that birds sense the global environmental factors.
+func (s *Simulation) buildEnvironment() *environmentLayers {
+	worldSize := float64(s.config.WorldSize)
+	regionTemperatures := make(map[int]float64)
+	for _, zone := range s.state.TemperatureZones {
+		regionTemperatures[s.regionOf(s.temperatureZonePosition(zone))] = zone.Temperature
+	}
+	var points []controlPoint
+	covered := make(map[int]bool)
+	for _, zone := range s.state.Zones {
+		temperature := zone.Temperature
+		region := s.regionOf(zone.Position)
+		if regional, ok := regionTemperatures[region]; ok {
+			temperature = regional
+		}
+		covered[region] = true
+		points = append(points, controlPoint{zone.Position, [4]float64{temperature, zone.SeasonalAmplitude, zone.FoodAvailability, zone.PredatorPresence}})
+	}
+	// Temperature zones without a zone only set the temperature; the other
+	// factors come from the zones around them
+	temperaturePoints := len(points)
+	for _, zone := range s.state.TemperatureZones {
+		position := s.temperatureZonePosition(zone)
+		if !covered[s.regionOf(position)] {
+			points = append(points, controlPoint{position, [4]float64{zone.Temperature, 0, 0, 0}})
+		}
+	}
+	fallback := [4]float64{referenceTemperature, 0, 1, s.env.PredatorPresence}
+
+	resolution := s.config.EnvironmentResolution
+	if resolution <= 0 {
+		resolution = defaultEnvironmentResolution
+	}
+	resolution = min(resolution, maxEnvironmentResolution)
+
+	interpolated := func(layer int) *raster {
+		candidates := points
+		if layer != 0 {
+			candidates = points[:temperaturePoints]
+		}
+		values := make([]float64, resolution*resolution)
+		cell := worldSize / float64(resolution)
+		for row := 0; row < resolution; row++ {
+			for col := 0; col < resolution; col++ {
+				centre := [2]float64{(float64(col) + 0.5) * cell, (float64(row) + 0.5) * cell}
+				values[row*resolution+col] = s.interpolate(candidates, layer, centre, fallback[layer])
+			}
+		}
+		return newRaster(resolution, resolution, worldSize, values)
+	}
+
+	grid := s.config.EnvironmentGrid
+	layer := func(index int, given func(*EnvironmentGrid) []float64) *raster {
+		if grid != nil && grid.Cols > 0 && grid.Rows > 0 && len(given(grid)) == grid.Cols*grid.Rows {
+			return newRaster(grid.Cols, grid.Rows, worldSize, given(grid))
+		}
+		return interpolated(index)
+	}
+	return &environmentLayers{
+		temperature:       layer(0, func(g *EnvironmentGrid) []float64 { return g.Temperature }),
+		seasonalAmplitude: layer(1, func(g *EnvironmentGrid) []float64 { return g.SeasonalAmplitude }),
+		food:              layer(2, func(g *EnvironmentGrid) []float64 { return g.FoodAvailability }),
+		predators:         layer(3, func(g *EnvironmentGrid) []float64 { return g.PredatorPresence }),
+	}
+}
+
+// interpolate returns the inverse distance weighted mean of the layer values
+// of points at pos, or fallback if there are no points. Points weigh by
+// their distance the shortest way around a torus.
+func (s *Simulation) interpolate(points []controlPoint, layer int, pos [2]float64, fallback float64) float64 {
+	if len(points) == 0 {
+		return fallback
+	}
+	var sum, weights float64
+	for _, point := range points {
+		dist := s.dist(pos, point.position)
+		if dist < 1e-9 {
+			return point.values[layer]
+		}
+		weight := 1 / (dist * dist)
+		sum += weight * point.values[layer]
+		weights += weight
+	}
+	return sum / weights
+}
+
+// conditionsAt samples the environmental layers at pos, with the
+// temperature of the current season. The global temperature shifts the
+// layers by its difference from referenceTemperature and the global food
+// availability scales them, so that both apply without rebuilding them.
+func (s *Simulation) conditionsAt(pos [2]float64) conditions {
+	s.prepareIndexes()
+	layers := s.environment
+	return conditions{
+		Temperature:      layers.temperature.sample(pos) + layers.seasonalAmplitude.sample(pos)*s.seasonalFactor() + s.temperatureShift(),
+		FoodAvailability: layers.food.sample(pos) * s.env.FoodAvailability,
+		PredatorPresence: layers.predators.sample(pos),
+	}
+}
+
+// temperatureShift is how much warmer the world is than the zones and grid
+// say, following the global temperature.
+func (s *Simulation) temperatureShift() float64 {
+	return s.env.Temperature - referenceTemperature
+}
+
+// temperatureZonePosition returns the centre of the region of a temperature
+// zone. The regions are the quarters of the world food moves between,
+// numbered row by row from the origin.
+func (s *Simulation) temperatureZonePosition(zone TemperatureZone) [2]float64 {
+	quarter := float64(s.config.WorldSize) / 4
+	region := (zone.Region%4 + 4) % 4
+	col, row := float64(region%2), float64(region/2)
+	return [2]float64{(2*col + 1) * quarter, (2*row + 1) * quarter}
+}
+
+// regionOf returns the region, as numbered for temperature zones, pos lies
+// in.
+func (s *Simulation) regionOf(pos [2]float64) int {
+	half := float64(s.config.WorldSize) / 2
+	region := 0
+	if pos[0] >= half {
+		region++
+	}
+	if pos[1] >= half {
+		region += 2
+	}
+	return region
+}
@@ -0,0 +1,79 @@
+package engine
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestUpdateEnvironmentChangesConditions(t *testing.T) {
+	env := EnvironmentalFactors{Temperature: 20, FoodAvailability: 1, PredatorPresence: 0.2}
+	s := New(SimulationConfig{WorldSize: 400, InitialBirds: 10, Seed: 1}, env)
+	if len(s.state.Zones) == 0 {
+		t.Fatal("the world has no zones")
+	}
+	pos := s.state.Zones[0].Position
+	before := s.conditionsAt(pos)
+
+	env.Temperature += 5
+	env.FoodAvailability = 0.5
+	s.UpdateEnvironment(env)
+	after := s.conditionsAt(pos)
+	if math.Abs(after.Temperature-before.Temperature-5) > 1e-9 {
+		t.Errorf("temperature went from %g to %g, want 5 °C warmer", before.Temperature, after.Temperature)
+	}
+	if math.Abs(after.FoodAvailability-before.FoodAvailability/2) > 1e-9 {
+		t.Errorf("food availability went from %g to %g, want half", before.FoodAvailability, after.FoodAvailability)
+	}
+}
+
+// A new predator presence brings or takes away predators, keeping the birds,
+// the resources and the clock.
+func TestPredatorPresenceKeepsWorld(t *testing.T) {
+	env := EnvironmentalFactors{Temperature: 20, FoodAvailability: 1, PredatorPresence: 0.2}
+	s := New(SimulationConfig{WorldSize: 400, InitialBirds: 30, Seed: 1}, env)
+	s.Start()
+	for range 5 {
+		s.Step()
+	}
+	before := s.Snapshot()
+
+	for _, presence := range []float64{0.5, 0.1, 0} {
+		env.PredatorPresence = presence
+		s.UpdateEnvironment(env)
+		after := s.Snapshot()
+		if want := max(int(presence*10), 1); len(after.Predators) != want {
+			t.Errorf("presence %g: %d predators, want %d", presence, len(after.Predators), want)
+		}
+		if after.Time != before.Time || !reflect.DeepEqual(after.Birds, before.Birds) || !reflect.DeepEqual(after.Resources, before.Resources) {
+			t.Fatalf("presence %g regenerated the world", presence)
+		}
+	}
+	ids := make(map[int]bool)
+	for _, predator := range s.Snapshot().Predators {
+		if ids[predator.ID] {
+			t.Errorf("predator ID %d reused", predator.ID)
+		}
+		ids[predator.ID] = true
+	}
+}
+
+// Without zones birds sense the global factors, and the world keeps going.
+func TestConditionsWithoutZones(t *testing.T) {
+	env := EnvironmentalFactors{Temperature: 7, FoodAvailability: 0.3, PredatorPresence: 0.2}
+	s := New(SimulationConfig{WorldSize: 400, InitialBirds: 10, Seed: 1}, env)
+	s.SetZones(nil)
+	here := s.conditionsAt([2]float64{100, 300})
+	if math.Abs(here.Temperature-7) > 1e-9 || math.Abs(here.FoodAvailability-0.3) > 1e-9 || math.Abs(here.PredatorPresence-0.2) > 1e-9 {
+		t.Errorf("conditions are %+v, want the global factors", here)
+	}
+	env.PredatorPresence = 0.7
+	s.UpdateEnvironment(env)
+	if here := s.conditionsAt([2]float64{100, 300}); math.Abs(here.PredatorPresence-0.7) > 1e-9 {
+		t.Errorf("predator presence is %g after the update, want 0.7", here.PredatorPresence)
+	}
+	s.state.Resources[0].Current = 0
+	for range 10 {
+		s.Step()
+	}
+}
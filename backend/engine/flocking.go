@@ -0,0 +1,115 @@
+package engine
+
+import "math"
+
+// DefaultFlocking is used for the flocking parameters left at zero.
+var DefaultFlocking = FlockingConfig{
+	SeparationWeight: 1.5,
+	AlignmentWeight:  1.0,
+	CohesionWeight:   1.0,
+	TargetWeight:     1.0,
+	PerceptionRadius: 25,
+	FieldOfView:      270,
+	MaxSpeed:         1,
+	MaxForce:         0.1,
+}
+
+// withDefaults fills the unset parameters of f from DefaultFlocking.
+func (f FlockingConfig) withDefaults() FlockingConfig {
+	if f.SeparationWeight == 0 && f.AlignmentWeight == 0 && f.CohesionWeight == 0 && f.TargetWeight == 0 {
+		f.SeparationWeight = DefaultFlocking.SeparationWeight
+		f.AlignmentWeight = DefaultFlocking.AlignmentWeight
+		f.CohesionWeight = DefaultFlocking.CohesionWeight
+		f.TargetWeight = DefaultFlocking.TargetWeight
+	}
+	if f.PerceptionRadius <= 0 {
+		f.PerceptionRadius = DefaultFlocking.PerceptionRadius
+	}
+	if f.FieldOfView <= 0 || f.FieldOfView > 360 {
+		f.FieldOfView = DefaultFlocking.FieldOfView
+	}
+	if f.MaxSpeed <= 0 {
+		f.MaxSpeed = DefaultFlocking.MaxSpeed
+	}
+	if f.MaxForce <= 0 {
+		f.MaxForce = DefaultFlocking.MaxForce
+	}
+	return f
+}
+
+// flock returns the steering force of the boids model for bird i of prev:
+// separation from every visible bird, alignment with and cohesion towards
+// the visible birds of its group, and a pull towards target. neighbours
+// indexes the positions of prev. It only reads its arguments, so it may run
+// concurrently for different birds.
+func (s *Simulation) flock(prev []Bird, i int, neighbours *spatialIndex, target [2]float64) [2]float64 {
+	params := s.config.Flocking
+	bird := prev[i]
+	minCos := math.Cos(params.FieldOfView / 2 * math.Pi / 180)
+	heading := normalize(bird.Velocity)
+	hasHeading := heading != [2]float64{}
+
+	var separation, alignment, centre [2]float64 // Centre relative to the bird
+	separated, aligned := 0, 0
+	neighbours.query(bird.Position, params.PerceptionRadius, func(j int) {
+		if j == i {
+			return
+		}
+		other := prev[j]
+		offset := s.offset(bird.Position, other.Position)
+		dist := math.Hypot(offset[0], offset[1])
+		if dist == 0 {
+			return
+		}
+		// Birds behind the bird, outside its field of view, are ignored
+		if hasHeading && params.FieldOfView < 360 && (offset[0]*heading[0]+offset[1]*heading[1])/dist < minCos {
+			return
+		}
+
+		// Push away harder from closer birds
+		separation[0] -= offset[0] / (dist * dist)
+		separation[1] -= offset[1] / (dist * dist)
+		separated++
+
+		if other.Group == bird.Group {
+			alignment[0] += other.Velocity[0]
+			alignment[1] += other.Velocity[1]
+			centre[0] += offset[0]
+			centre[1] += offset[1]
+			aligned++
+		}
+	})
+
+	// Every bird weighs the rules with the weights of its genome
+	var force [2]float64
+	speed := s.cruiseSpeed(&bird)
+	add := func(weight float64, desired [2]float64) {
+		steer := steer(bird.Velocity, desired, speed)
+		force[0] += weight * steer[0]
+		force[1] += weight * steer[1]
+	}
+	if separated > 0 {
+		add(bird.Genome.SeparationWeight, separation)
+	}
+	if aligned > 0 {
+		add(bird.Genome.AlignmentWeight, alignment)
+		add(bird.Genome.CohesionWeight, [2]float64{centre[0] / float64(aligned), centre[1] / float64(aligned)})
+	}
+	add(params.TargetWeight, s.offset(bird.Position, target))
+	return limit(force, params.MaxForce)
+}
+
+// steer returns the change of velocity that turns velocity into a flight at
+// speed in the given direction, or nothing if direction is null.
+func steer(velocity, direction [2]float64, speed float64) [2]float64 {
+	direction = normalize(direction)
+	if direction == [2]float64{} {
+		return direction
+	}
+	return [2]float64{direction[0]*speed - velocity[0], direction[1]*speed - velocity[1]}
+}
+
+// cruiseSpeed returns the speed bird migrates at.
+func (s *Simulation) cruiseSpeed(bird *Bird) float64 {
+	return s.config.Flocking.MaxSpeed * bird.Genome.Speed
+}
@@ -0,0 +1,167 @@
+package engine
+
+import (
+	"math"
+	"sort"
+)
+
+// Genome holds the heritable traits of a bird. Offspring inherit every gene
+// from one of their parents, possibly mutated, so that selection by
+// predation and starvation shapes the population over generations.
+type Genome struct {
+	PreferredTemperature float64 `json:"preferredTemperature"` // °C; birds leave places colder by more than the TemperatureTolerance of their species
+	Speed                float64 `json:"speed"`                // Multiplier of the cruise speed
+	SeparationWeight     float64 `json:"separationWeight"`
+	AlignmentWeight      float64 `json:"alignmentWeight"`
+	CohesionWeight       float64 `json:"cohesionWeight"`
+	MigrationTiming      float64 `json:"migrationTiming"` // 0 to 1: how late in a migration season a bird departs, and how fed it must be before leaving food
+	RiskAversion         float64 `json:"riskAversion"`    // 0 to 1: how early a bird flees and hides from predators
+}
+
+// gene describes one trait of the genome: its name in trait reports, its
+// bounds and how to reach it.
+type gene struct {
+	name   string
+	lo, hi float64
+	value  func(g *Genome) *float64
+}
+
+var genes = []gene{
+	{"preferredTemperature", -10, 40, func(g *Genome) *float64 { return &g.PreferredTemperature }},
+	{"speed", 0.5, 2, func(g *Genome) *float64 { return &g.Speed }},
+	{"separationWeight", 0, 5, func(g *Genome) *float64 { return &g.SeparationWeight }},
+	{"alignmentWeight", 0, 5, func(g *Genome) *float64 { return &g.AlignmentWeight }},
+	{"cohesionWeight", 0, 5, func(g *Genome) *float64 { return &g.CohesionWeight }},
+	{"migrationTiming", 0, 1, func(g *Genome) *float64 { return &g.MigrationTiming }},
+	{"riskAversion", 0, 1, func(g *Genome) *float64 { return &g.RiskAversion }},
+}
+
+// geneNamed returns the gene called name in trait reports.
+func geneNamed(name string) gene {
+	for _, g := range genes {
+		if g.name == name {
+			return g
+		}
+	}
+	panic("unknown gene " + name)
+}
+
+// defaultGenome is the genome founders vary around. Its flocking weights
+// come from the run configuration.
+func (s *Simulation) defaultGenome() Genome {
+	return Genome{
+		PreferredTemperature: 20,
+		Speed:                1,
+		SeparationWeight:     s.config.Flocking.SeparationWeight,
+		AlignmentWeight:      s.config.Flocking.AlignmentWeight,
+		CohesionWeight:       s.config.Flocking.CohesionWeight,
+		MigrationTiming:      0.8,
+		RiskAversion:         0.5,
+	}
+}
+
+// founderGenome returns the genome of an initial bird of species: the
+// default genome with the traits of the species, every gene varied so that
+// selection has variation to act on from the first generation.
+func (s *Simulation) founderGenome(species *Species) Genome {
+	genome := s.defaultGenome()
+	genome.PreferredTemperature = species.PreferredTemperature
+	genome.Speed = species.Speed
+	genome.SeparationWeight = species.SeparationWeight
+	genome.AlignmentWeight = species.AlignmentWeight
+	genome.CohesionWeight = species.CohesionWeight
+	for _, g := range genes {
+		s.vary(&genome, g)
+	}
+	return genome
+}
+
+// inherit builds the genome of a chick, taking every gene from either parent
+// and mutating it with probability MutationRate.
+func (s *Simulation) inherit(parent1, parent2 *Genome) Genome {
+	var genome Genome
+	for _, g := range genes {
+		parent := parent1
+		if s.rng.Float64() < 0.5 {
+			parent = parent2
+		}
+		*g.value(&genome) = *g.value(parent)
+		if s.config.MutationRate > 0 && s.rng.Float64() < s.config.MutationRate {
+			s.vary(&genome, g)
+		}
+	}
+	return genome
+}
+
+// vary adds gaussian noise to a gene, MutationScale times the width of its
+// range, and keeps it in range.
+func (s *Simulation) vary(genome *Genome, g gene) {
+	value := g.value(genome)
+	*value += s.rng.NormFloat64() * s.config.MutationScale * (g.hi - g.lo)
+	*value = math.Max(g.lo, math.Min(g.hi, *value))
+}
+
+// departure returns the share of a migration season that elapses before a
+// bird departs: birds with an early migration timing leave first.
+func (g Genome) departure() float64 {
+	return g.MigrationTiming * departureWindow
+}
+
+// satedEnergy returns the energy at which a feeding bird leaves: birds
+// with an early migration timing leave with less.
+func (g Genome) satedEnergy() float64 {
+	return hungryEnergy + g.MigrationTiming*(maxEnergy-hungryEnergy)
+}
+
+// TraitStats summarizes the values of one trait.
+type TraitStats struct {
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"stdDev"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+}
+
+// GenerationTraits is the distribution of the traits of the living birds of
+// one generation.
+type GenerationTraits struct {
+	Generation int                   `json:"generation"`
+	Count      int                   `json:"count"`
+	Traits     map[string]TraitStats `json:"traits"`
+}
+
+// TraitDistributions reports, for every generation with living birds in
+// order, the distribution of each trait.
+func TraitDistributions(birds []Bird) []GenerationTraits {
+	byGeneration := make(map[int][]Bird)
+	for _, bird := range birds {
+		byGeneration[bird.Generation] = append(byGeneration[bird.Generation], bird)
+	}
+	generations := make([]int, 0, len(byGeneration))
+	for generation := range byGeneration {
+		generations = append(generations, generation)
+	}
+	sort.Ints(generations)
+
+	distributions := make([]GenerationTraits, 0, len(generations))
+	for _, generation := range generations {
+		members := byGeneration[generation]
+		traits := make(map[string]TraitStats, len(genes))
+		for _, g := range genes {
+			stats := TraitStats{Min: math.Inf(1), Max: math.Inf(-1)}
+			var sum, sumSquares float64
+			for i := range members {
+				value := *g.value(&members[i].Genome)
+				sum += value
+				sumSquares += value * value
+				stats.Min = math.Min(stats.Min, value)
+				stats.Max = math.Max(stats.Max, value)
+			}
+			n := float64(len(members))
+			stats.Mean = sum / n
+			stats.StdDev = math.Sqrt(math.Max(0, sumSquares/n-stats.Mean*stats.Mean))
+			traits[g.name] = stats
+		}
+		distributions = append(distributions, GenerationTraits{Generation: generation, Count: len(members), Traits: traits})
+	}
+	return distributions
+}
@@ -0,0 +1,74 @@
+package engine
+
+import "math"
+
+func distance(pos1 [2]float64, pos2 [2]float64) float64 {
+	dx := pos1[0] - pos2[0]
+	dy := pos1[1] - pos2[1]
+	return math.Sqrt(dx*dx + dy*dy)
+}
+
+func normalize(vec [2]float64) [2]float64 {
+	mag := math.Sqrt(vec[0]*vec[0] + vec[1]*vec[1])
+	if mag > 0 {
+		return [2]float64{vec[0] / mag, vec[1] / mag}
+	}
+	return vec
+}
+
+// limit scales vec down so that its length is at most maxLength.
+func limit(vec [2]float64, maxLength float64) [2]float64 {
+	mag := math.Sqrt(vec[0]*vec[0] + vec[1]*vec[1])
+	if mag > maxLength && mag > 0 {
+		return [2]float64{vec[0] / mag * maxLength, vec[1] / mag * maxLength}
+	}
+	return vec
+}
+
+// segmentIntersection returns the share of the way from p1 to p2 at which
+// the segment crosses the segment from q1 to q2, and whether they cross.
+func segmentIntersection(p1, p2, q1, q2 [2]float64) (float64, bool) {
+	r := [2]float64{p2[0] - p1[0], p2[1] - p1[1]}
+	d := [2]float64{q2[0] - q1[0], q2[1] - q1[1]}
+	denominator := cross(r, d)
+	if denominator == 0 {
+		return 0, false
+	}
+	w := [2]float64{q1[0] - p1[0], q1[1] - p1[1]}
+	t := cross(w, d) / denominator
+	u := cross(w, r) / denominator
+	if t < 0 || t > 1 || u < 0 || u > 1 {
+		return 0, false
+	}
+	return t, true
+}
+
+// closestPointOnSegment returns the point of the segment from a to b closest
+// to pos.
+func closestPointOnSegment(pos, a, b [2]float64) [2]float64 {
+	ab := [2]float64{b[0] - a[0], b[1] - a[1]}
+	length2 := ab[0]*ab[0] + ab[1]*ab[1]
+	if length2 == 0 {
+		return a
+	}
+	t := math.Max(0, math.Min(1, ((pos[0]-a[0])*ab[0]+(pos[1]-a[1])*ab[1])/length2))
+	return [2]float64{a[0] + ab[0]*t, a[1] + ab[1]*t}
+}
+
+// cross returns the z component of the cross product of two vectors.
+func cross(a, b [2]float64) float64 {
+	return a[0]*b[1] - a[1]*b[0]
+}
+
+// wrappedOffset returns the vector from one point to another. With a
+// positive period, the world wraps around every period and the vector is the
+// shortest one between any copies of the points.
+func wrappedOffset(from, to [2]float64, period float64) [2]float64 {
+	offset := [2]float64{to[0] - from[0], to[1] - from[1]}
+	if period > 0 {
+		for axis := 0; axis < 2; axis++ {
+			offset[axis] -= period * math.Round(offset[axis]/period)
+		}
+	}
+	return offset
+}
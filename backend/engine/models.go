@@ -0,0 +1,227 @@
+package engine
+
+import (
+	"maps"
+	"slices"
+)
+
+// --- Models ---
+type Bird struct {
+	ID            int        `json:"id"`
+	Position      [2]float64 `json:"position"`
+	Altitude      float64    `json:"altitude"` // Above the ground level of the world, not of the terrain
+	Velocity      [2]float64 `json:"velocity"`
+	State         string     `json:"state"`
+	Target        [2]float64 `json:"target"`
+	Group         int        `json:"group"`
+	CollisionTime int64      `json:"collisionTime"` // Time when the collision was first detected
+	Energy        float64    `json:"energy"`        // 0 to 100, spent flying, replenished by food
+	Fatigue       float64    `json:"fatigue"`       // 0 to 100, built up flying, recovered by resting
+
+	Age              int  `json:"age"` // Ticks since hatching
+	Juvenile         bool `json:"juvenile"`
+	Generation       int  `json:"generation"`       // 0 for the initial birds
+	LastBreedingYear int  `json:"lastBreedingYear"` // -1 if the bird never bred
+
+	Species string `json:"species"`
+	Genome  Genome `json:"genome"`
+}
+
+// Obstacle is either a mountain raised on the terrain, Height high at its
+// centre and about Radius wide, or a structure birds fly around: a polygon
+// (a building, an island) or a line of segments (a coastline, a row of wind
+// turbines) through Points. Structures reach Height above the ground; zero
+// means they cannot be flown over. The position and radius of a structure
+// are those of the circle around it, set by the simulation.
+type Obstacle struct {
+	ID       int          `json:"id"`
+	Shape    string       `json:"shape,omitempty"` // "circle" (default), "polygon" or "polyline"
+	Position [2]float64   `json:"position"`
+	Radius   float64      `json:"radius"`
+	Height   float64      `json:"height"`
+	Points   [][2]float64 `json:"points,omitempty"`
+}
+
+type Resource struct {
+	ID       int        `json:"id"`
+	Position [2]float64 `json:"position"`
+	Type     string     `json:"type"`
+	Capacity int        `json:"capacity"`
+	Current  int        `json:"current"`
+}
+
+type Predator struct {
+	ID       int        `json:"id"`
+	Position [2]float64 `json:"position"`
+	Velocity [2]float64 `json:"velocity"`
+	State    string     `json:"state"`   // patrolling, hunting or resting
+	Target   int        `json:"target"`  // ID of the bird being chased, -1 for none
+	Energy   float64    `json:"energy"`  // 0 to 100; the predator starves at 0
+	Satiety  float64    `json:"satiety"` // 1 after a kill, decreasing while digesting
+}
+
+type Zone struct {
+	ID               int        `json:"id"`
+	Position         [2]float64 `json:"position"`
+	Temperature      float64    `json:"temperature"`
+	FoodAvailability float64    `json:"foodAvailability"`
+	PredatorPresence float64    `json:"predatorPresence"`
+	// Temperature is the mean over the year; it is SeasonalAmplitude °C
+	// warmer at midsummer and as much colder at midwinter.
+	SeasonalAmplitude float64 `json:"seasonalAmplitude"`
+	// Role is "breeding" for the zones birds fly to in spring, "wintering"
+	// for those they fly to in autumn, or empty.
+	Role string `json:"role,omitempty"`
+}
+
+// TemperatureZone sets the mean temperature of a region of the world, one of
+// its quarters numbered row by row from the origin.
+type TemperatureZone struct {
+	Region      int        `json:"region"`
+	Temperature float64    `json:"temperature"`
+	Position    [2]float64 `json:"position"` // Centre of the region, set by the simulation
+}
+
+type SimulationState struct {
+	Birds            []Bird            `json:"birds"`
+	Time             int               `json:"time"`
+	IsRunning        bool              `json:"isRunning"`
+	WorldSize        int               `json:"worldSize"`
+	Obstacles        []Obstacle        `json:"obstacles"`
+	Resources        []Resource        `json:"resources"`
+	CollisionCount   int               `json:"collisionCount"` // Between birds
+	StrikeCount      int               `json:"strikeCount"`    // Birds flying into a structure
+	Predators        []Predator        `json:"predators"`
+	TemperatureZones []TemperatureZone `json:"temperatureZones"`
+	Zones            []Zone            `json:"zones"`
+	Seed             int64             `json:"seed"` // Seed actually used to generate this run
+	Population       Population        `json:"population"`
+	Year             int               `json:"year"`
+	Day              int               `json:"day"`     // Day of the year, from 0
+	Season           string            `json:"season"`  // "spring", "summer", "autumn" or "winter"
+	Daytime          bool              `json:"daytime"` // Whether it is day or night
+}
+
+type SimulationConfig struct {
+	// SimulationSpeed is the number of milliseconds between two ticks. Zero
+	// runs the simulation as fast as possible.
+	SimulationSpeed int `json:"simulationSpeed"`
+	WorldSize       int `json:"worldSize"`
+	InitialBirds    int `json:"initialBirds"`
+	ObstacleCount   int `json:"obstacleCount"`
+	ResourceCount   int `json:"resourceCount"`
+	// Seed makes runs reproducible. Zero picks a new seed on every reset.
+	Seed int64 `json:"seed"`
+	// Workers is the number of goroutines birds are updated on; zero uses
+	// every CPU. Results do not depend on it.
+	Workers int `json:"workers"`
+	// CaptureProbability is the chance that a predator catches a bird within
+	// its attack radius on a tick; the bird flees otherwise.
+	CaptureProbability float64 `json:"captureProbability"`
+	// CollisionMortality is the chance that a bird dies when it collides.
+	CollisionMortality float64 `json:"collisionMortality"`
+	// YearLength is the number of ticks in a simulated year; zero means 3600.
+	// DayLength is the number of ticks in a day; zero means 100.
+	YearLength int `json:"yearLength"`
+	DayLength  int `json:"dayLength"`
+	// CarryingCapacity caps the population breeding can reach; zero means
+	// four times InitialBirds.
+	CarryingCapacity int `json:"carryingCapacity"`
+	// MutationRate is the chance that a gene mutates when inherited, and
+	// MutationScale the standard deviation of a mutation relative to the
+	// range of the gene. The initial birds vary by MutationScale too.
+	MutationRate  float64 `json:"mutationRate"`
+	MutationScale float64 `json:"mutationScale"`
+	// Species is the mix of the initial population; empty means a single
+	// default species. Species also compete for the resources they share.
+	Species []SpeciesShare `json:"species"`
+	// EnvironmentResolution is the number of cells per side of the
+	// environmental layers interpolated from the zones; zero means 100.
+	// EnvironmentGrid gives layers explicitly instead.
+	EnvironmentResolution int              `json:"environmentResolution"`
+	EnvironmentGrid       *EnvironmentGrid `json:"environmentGrid,omitempty"`
+	// Terrain is the elevation of the ground; nil generates rolling hills.
+	// Obstacles are raised on it as mountains.
+	Terrain *Heightmap `json:"terrain,omitempty"`
+	// Obstacles are placed in the world besides the ObstacleCount mountains
+	// generated on every reset.
+	Obstacles []Obstacle `json:"obstacles,omitempty"`
+	// Boundary is what happens at the edges of the world: "clamp" (the
+	// default) stops birds there, "reflect" bounces them off, "torus" wraps
+	// them around to the opposite edge, "soft" turns them back within a
+	// margin, and "open" lets them fly out and emigrate.
+	Boundary string `json:"boundary,omitempty"`
+	// Flocking tunes how migrating birds fly together.
+	Flocking FlockingConfig `json:"flocking"`
+}
+
+// FlockingConfig holds the parameters of the boids model followed by
+// migrating birds. The weights are those the initial birds inherit around;
+// every bird then flies with the weights of its genome. Zero values are
+// replaced by the defaults when the simulation is reset; the weights are only
+// defaulted when all of them are zero, so that a single rule can be switched
+// off.
+type FlockingConfig struct {
+	SeparationWeight float64 `json:"separationWeight"`
+	AlignmentWeight  float64 `json:"alignmentWeight"`
+	CohesionWeight   float64 `json:"cohesionWeight"`
+	TargetWeight     float64 `json:"targetWeight"`     // Pull towards the migration target of the group
+	PerceptionRadius float64 `json:"perceptionRadius"` // Distance at which a bird sees its neighbours
+	FieldOfView      float64 `json:"fieldOfView"`      // Degrees, centred on the heading of the bird
+	MaxSpeed         float64 `json:"maxSpeed"`         // Cruise speed, distance per tick at time step 1
+	MaxForce         float64 `json:"maxForce"`         // Largest change of velocity per tick
+}
+
+type EnvironmentalFactors struct {
+	Temperature      float64    `json:"temperature"`
+	FoodAvailability float64    `json:"foodAvailability"`
+	PredatorPresence float64    `json:"predatorPresence"`
+	Wind             WindConfig `json:"wind"`
+}
+
+// WindConfig describes the wind blowing over the world. It drifts birds and
+// predators and makes flying against it more costly.
+type WindConfig struct {
+	// Mode is "uniform", "gradient" (strengthening across the world,
+	// perpendicular to Direction) or "noise" (varying from place to place
+	// with Perlin noise). Empty or "none" means no wind.
+	Mode string `json:"mode"`
+	// Speed is the mean wind speed, distance per tick at time step 1, and
+	// Direction the heading the wind blows towards in degrees, 0 along x.
+	Speed     float64 `json:"speed"`
+	Direction float64 `json:"direction"`
+	// Variability is how much the wind veers and gusts over a Period of
+	// ticks, from 0 (steady) to 1. Zero Period means 600 ticks.
+	Variability float64 `json:"variability"`
+	Period      int     `json:"period"`
+	// Scale is the size of the noise features; zero means a quarter of the
+	// world.
+	Scale float64 `json:"scale"`
+}
+
+// Clone returns a copy of the state that shares no slices with the original.
+func (s SimulationState) Clone() SimulationState {
+	clone := s
+	clone.Birds = slices.Clone(s.Birds)
+	clone.Obstacles = cloneObstacles(s.Obstacles)
+	clone.Resources = slices.Clone(s.Resources)
+	clone.Predators = slices.Clone(s.Predators)
+	clone.TemperatureZones = slices.Clone(s.TemperatureZones)
+	clone.Zones = slices.Clone(s.Zones)
+	clone.Population.Species = maps.Clone(s.Population.Species)
+	return clone
+}
+
+// Clone returns a copy of the configuration that shares no slices with the
+// original.
+func (c SimulationConfig) Clone() SimulationConfig {
+	clone := c
+	clone.Species = slices.Clone(c.Species)
+	for i := range clone.Species {
+		clone.Species[i].Diet = slices.Clone(clone.Species[i].Diet)
+	}
+	clone.EnvironmentGrid = c.EnvironmentGrid.Clone()
+	clone.Terrain = c.Terrain.Clone()
+	clone.Obstacles = cloneObstacles(c.Obstacles)
+	return clone
+}
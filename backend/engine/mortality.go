@@ -0,0 +1,104 @@
+package engine
+
+// Population counts the living birds, and the deaths and departures of the
+// run by cause.
+type Population struct {
+	Alive            int `json:"alive"`
+	KilledByPredator int `json:"killedByPredator"`
+	Starved          int `json:"starved"`   // Ran out of energy
+	Exhausted        int `json:"exhausted"` // Flew until fatigue peaked
+	Collided         int `json:"collided"`
+	Struck           int `json:"struck"`    // Flew into a structure
+	Emigrated        int `json:"emigrated"` // Flew out of an open world
+	OldAge           int `json:"oldAge"`
+	Born             int `json:"born"`
+	Juveniles        int `json:"juveniles"` // Living birds not yet adult
+
+	Species map[string]int `json:"species"` // Living birds by species
+}
+
+// Causes of death
+const (
+	killedByPredator = iota
+	starved
+	exhausted
+	collided
+	struck
+	emigrated
+	oldAge
+)
+
+// kill marks bird as dead and records the cause. Dead birds stay in Birds
+// until the end of the tick, so that indexes built during the tick remain
+// valid, and are removed by removeDead. Birds that emigrate leave the same
+// way.
+func (s *Simulation) kill(bird *Bird, cause int) {
+	if bird.State == "dead" {
+		return
+	}
+	bird.State = "dead"
+	switch cause {
+	case killedByPredator:
+		s.state.Population.KilledByPredator++
+	case starved:
+		s.state.Population.Starved++
+	case exhausted:
+		s.state.Population.Exhausted++
+	case collided:
+		s.state.Population.Collided++
+	case struck:
+		s.state.Population.Struck++
+	case emigrated:
+		s.state.Population.Emigrated++
+	case oldAge:
+		s.state.Population.OldAge++
+	}
+}
+
+// checkHealth kills the birds with no energy left, at peak fatigue, or old
+// enough to die of age.
+func (s *Simulation) checkHealth() {
+	oldAgeMortality := 1 / float64(s.yearLength())
+	for i := range s.state.Birds {
+		bird := &s.state.Birds[i]
+		if bird.Energy <= 0 {
+			s.kill(bird, starved)
+		} else if bird.Fatigue >= maxEnergy {
+			s.kill(bird, exhausted)
+		} else if bird.Age > s.senescenceAge() && s.rng.Float64() < oldAgeMortality {
+			s.kill(bird, oldAge)
+		}
+	}
+}
+
+// removeDead drops the birds that died during the tick.
+func (s *Simulation) removeDead() {
+	alive := s.state.Birds[:0]
+	for _, bird := range s.state.Birds {
+		if bird.State != "dead" {
+			alive = append(alive, bird)
+		}
+	}
+	clear(s.state.Birds[len(alive):])
+	s.state.Birds = alive
+	s.birdIndex = nil
+	s.countPopulation()
+}
+
+// countPopulation updates the counts of living birds.
+func (s *Simulation) countPopulation() {
+	s.state.Population.Alive = len(s.state.Birds)
+	s.state.Population.Juveniles = 0
+	// A new map, as snapshots share the previous one
+	s.state.Population.Species = make(map[string]int, len(s.config.Species))
+	for _, share := range s.config.Species {
+		s.state.Population.Species[share.Name] = 0
+	}
+	for i := range s.state.Birds {
+		bird := &s.state.Birds[i]
+		if bird.Juvenile {
+			s.state.Population.Juveniles++
+		}
+		s.state.Population.Species[s.speciesOf(bird).Name]++
+	}
+}
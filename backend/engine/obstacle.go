@@ -0,0 +1,210 @@
+package engine
+
+import (
+	"math"
+	"slices"
+)
+
+const obstacleLookahead = 30.0 // Distance ahead birds look for structures
+
+// Shapes of obstacles
+const (
+	circleShape   = "circle"   // A mountain of the terrain
+	polygonShape  = "polygon"  // A closed structure: a building, an island
+	polylineShape = "polyline" // A line of segments: a coastline, a row of wind turbines
+)
+
+// structure reports whether birds fly around the obstacle rather than over
+// the terrain it raises.
+func (o *Obstacle) structure() bool {
+	return o.Shape == polygonShape || o.Shape == polylineShape
+}
+
+// edges calls fn on every segment of the outline of a structure.
+func (o *Obstacle) edges(fn func(a, b [2]float64)) {
+	for i := 1; i < len(o.Points); i++ {
+		fn(o.Points[i-1], o.Points[i])
+	}
+	if o.Shape == polygonShape && len(o.Points) > 2 {
+		fn(o.Points[len(o.Points)-1], o.Points[0])
+	}
+}
+
+// contains reports whether pos lies inside a polygon, by counting the edges a
+// ray from the copy of pos nearest the polygon crosses.
+func (s *Simulation) contains(o *Obstacle, pos [2]float64) bool {
+	if o.Shape != polygonShape || s.dist(pos, o.Position) > o.Radius {
+		return false
+	}
+	pos = s.nearestCopy(pos, o)
+	inside := false
+	o.edges(func(a, b [2]float64) {
+		if (a[1] > pos[1]) != (b[1] > pos[1]) && pos[0] < a[0]+(pos[1]-a[1])*(b[0]-a[0])/(b[1]-a[1]) {
+			inside = !inside
+		}
+	})
+	return inside
+}
+
+// nearestCopy returns pos, moved around a torus to the copy nearest the
+// obstacle.
+func (s *Simulation) nearestCopy(pos [2]float64, o *Obstacle) [2]float64 {
+	toward := s.offset(o.Position, pos)
+	return [2]float64{o.Position[0] + toward[0], o.Position[1] + toward[1]}
+}
+
+// equal reports whether two obstacles are the same, points included.
+func (o Obstacle) equal(other Obstacle) bool {
+	return o.ID == other.ID && o.Shape == other.Shape && o.Position == other.Position &&
+		o.Radius == other.Radius && o.Height == other.Height && slices.Equal(o.Points, other.Points)
+}
+
+// cloneObstacles returns a copy of obstacles that shares no slices with the
+// original.
+func cloneObstacles(obstacles []Obstacle) []Obstacle {
+	clone := slices.Clone(obstacles)
+	for i := range clone {
+		clone[i].Points = slices.Clone(clone[i].Points)
+	}
+	return clone
+}
+
+// placeStructure sets the position and radius of a structure to the centre
+// and radius of the circle around its points.
+func placeStructure(obstacle *Obstacle) {
+	if len(obstacle.Points) == 0 {
+		return
+	}
+	lo, hi := obstacle.Points[0], obstacle.Points[0]
+	for _, point := range obstacle.Points {
+		lo = [2]float64{math.Min(lo[0], point[0]), math.Min(lo[1], point[1])}
+		hi = [2]float64{math.Max(hi[0], point[0]), math.Max(hi[1], point[1])}
+	}
+	obstacle.Position = [2]float64{(lo[0] + hi[0]) / 2, (lo[1] + hi[1]) / 2}
+	obstacle.Radius = 0
+	for _, point := range obstacle.Points {
+		obstacle.Radius = math.Max(obstacle.Radius, distance(obstacle.Position, point))
+	}
+}
+
+// blocks reports whether a structure stands in the way of a bird flying at
+// altitude. Structures reach Height above the ground at their centre; those
+// without a height cannot be flown over.
+func (s *Simulation) blocks(obstacle *Obstacle, altitude float64) bool {
+	return obstacle.structure() && (obstacle.Height <= 0 || altitude < s.top(obstacle))
+}
+
+// top returns the altitude of the top of a structure.
+func (s *Simulation) top(obstacle *Obstacle) float64 {
+	return s.elevation(obstacle.Position) + obstacle.Height
+}
+
+// groundLevel returns the altitude birds perch at and fly above at pos: the
+// elevation of the terrain, or the roof of the polygon pos lies in.
+func (s *Simulation) groundLevel(pos [2]float64) float64 {
+	s.prepareIndexes()
+	return s.groundOver(s.terrain, pos)
+}
+
+// groundOver returns the ground level at pos over terrain, which it takes
+// rather than preparing so that buildGround can use it.
+func (s *Simulation) groundOver(terrain *raster, pos [2]float64) float64 {
+	ground := terrain.sample(pos)
+	for i := range s.state.Obstacles {
+		obstacle := &s.state.Obstacles[i]
+		if obstacle.Height > 0 && s.contains(obstacle, pos) {
+			ground = math.Max(ground, terrain.sample(obstacle.Position)+obstacle.Height)
+		}
+	}
+	return ground
+}
+
+// castRay returns the share of the way from one point to another a bird
+// flying at altitude covers before it meets a structure, and whether it
+// meets one at all. On a torus to may lie past the edge of the world: the
+// structures are met where they are the short way around from from.
+func (s *Simulation) castRay(from, to [2]float64, altitude float64) (float64, bool) {
+	length := distance(from, to)
+	nearest, hit := 1.0, false
+	for i := range s.state.Obstacles {
+		obstacle := &s.state.Obstacles[i]
+		if !obstacle.structure() {
+			continue
+		}
+		toward := s.offset(from, obstacle.Position)
+		if reach := obstacle.Radius + length; toward[0]*toward[0]+toward[1]*toward[1] > reach*reach || !s.blocks(obstacle, altitude) {
+			continue
+		}
+		// Shift the outline to the copy of the structure nearest from
+		shift := [2]float64{from[0] + toward[0] - obstacle.Position[0], from[1] + toward[1] - obstacle.Position[1]}
+		obstacle.edges(func(a, b [2]float64) {
+			a = [2]float64{a[0] + shift[0], a[1] + shift[1]}
+			b = [2]float64{b[0] + shift[0], b[1] + shift[1]}
+			if t, ok := segmentIntersection(from, to, a, b); ok && t <= nearest {
+				nearest, hit = t, true
+			}
+		})
+	}
+	return nearest, hit
+}
+
+// obstructed reports whether a structure lies within obstacleLookahead of
+// bird along heading. In a bounded world the ray stops at the edges, as
+// birds do, so that they do not slip around structures outside of it.
+func (s *Simulation) obstructed(bird *Bird, heading [2]float64) bool {
+	ahead := [2]float64{bird.Position[0] + heading[0]*obstacleLookahead, bird.Position[1] + heading[1]*obstacleLookahead}
+	if boundary := s.boundary(); boundary != torusBoundary && boundary != openBoundary {
+		ahead = s.keepInside(ahead)
+	}
+	_, hit := s.castRay(bird.Position, ahead, bird.Altitude)
+	return hit
+}
+
+// detectStrikes stops the birds whose move this tick, from their record in
+// prev, went through a structure: they are counted as strikes, left just
+// short of it and may die of it.
+func (s *Simulation) detectStrikes(prev []Bird) {
+	for i := range s.state.Birds {
+		bird := &s.state.Birds[i]
+		from := prev[i].Position
+		if bird.State == "dead" || from == bird.Position {
+			continue
+		}
+		// The move, the short way around a torus
+		moved := s.offset(from, bird.Position)
+		t, hit := s.castRay(from, [2]float64{from[0] + moved[0], from[1] + moved[1]}, bird.Altitude)
+		if !hit {
+			continue
+		}
+		s.state.StrikeCount++
+		// Back off from the point of impact
+		back := math.Max(0, t-collisionThreshold/math.Hypot(moved[0], moved[1]))
+		bird.Position = s.keepInside([2]float64{from[0] + moved[0]*back, from[1] + moved[1]*back})
+		bird.Velocity = [2]float64{}
+		if s.config.CollisionMortality > 0 && s.rng.Float64() < s.config.CollisionMortality {
+			s.kill(bird, struck)
+		}
+	}
+}
+
+// outsideStructures moves pos out of the polygons it lies in, to just past
+// the closest point of their outline.
+func (s *Simulation) outsideStructures(pos [2]float64) [2]float64 {
+	for i := range s.state.Obstacles {
+		obstacle := &s.state.Obstacles[i]
+		if !s.contains(obstacle, pos) {
+			continue
+		}
+		local := s.nearestCopy(pos, obstacle)
+		closest, closestDist := local, math.MaxFloat64
+		obstacle.edges(func(a, b [2]float64) {
+			point := closestPointOnSegment(local, a, b)
+			if dist := distance(local, point); dist < closestDist {
+				closest, closestDist = point, dist
+			}
+		})
+		out := normalize([2]float64{closest[0] - local[0], closest[1] - local[1]})
+		pos = [2]float64{pos[0] + closest[0] - local[0] + out[0]*collisionThreshold, pos[1] + closest[1] - local[1] + out[1]*collisionThreshold}
+	}
+	return pos
+}
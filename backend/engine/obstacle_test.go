@@ -0,0 +1,50 @@
+package engine
+
+import (
+	"math"
+	"testing"
+)
+
+// A wall just past the seam of a torus stands in the way of birds on the
+// other side of it.
+func TestRaysAcrossTheSeam(t *testing.T) {
+	wall := Obstacle{Shape: polygonShape, Points: [][2]float64{{5, 100}, {15, 100}, {15, 200}, {5, 200}}}
+	config := SimulationConfig{WorldSize: 300, InitialBirds: 1, ObstacleCount: 1, Seed: 1, Boundary: torusBoundary, Obstacles: []Obstacle{wall}}
+	s := New(config, EnvironmentalFactors{Temperature: 20, FoodAvailability: 1})
+
+	t0, hit := s.castRay([2]float64{295, 150}, [2]float64{310, 150}, 10)
+	if !hit || math.Abs(t0-2.0/3) > 1e-9 {
+		t.Errorf("ray through the seam: %v at %g, want a hit at 2/3 of the way", hit, t0)
+	}
+	if _, hit := s.castRay([2]float64{25, 150}, [2]float64{-10, 150}, 10); !hit {
+		t.Error("ray towards the seam missed the wall")
+	}
+
+	// A bird that moved through the seam and the wall strikes it
+	prev := []Bird{{Position: [2]float64{295, 150}}}
+	s.state.Birds = []Bird{{Position: [2]float64{10, 150}, State: "migrating"}}
+	s.detectStrikes(prev)
+	if s.state.StrikeCount != 1 {
+		t.Fatalf("%d strikes, want 1", s.state.StrikeCount)
+	}
+	if x := s.state.Birds[0].Position[0]; x >= 5 && x <= 295 {
+		t.Errorf("bird left at x=%g, want between its start and the wall", x)
+	}
+}
+
+// A roof and the zones reach across the seam of a torus.
+func TestGroundAndConditionsAcrossTheSeam(t *testing.T) {
+	// The roof straddles the seam, reaching past a point just short of it
+	roof := Obstacle{Shape: polygonShape, Points: [][2]float64{{-5, 100}, {10, 100}, {10, 200}, {-5, 200}}, Height: 50}
+	config := SimulationConfig{WorldSize: 300, InitialBirds: 1, Seed: 1, Boundary: torusBoundary, Obstacles: []Obstacle{roof}}
+	s := New(config, EnvironmentalFactors{Temperature: 20, FoodAvailability: 1})
+	if !s.contains(&s.state.Obstacles[0], [2]float64{298, 150}) {
+		t.Error("the point across the seam is not under the roof")
+	}
+
+	// A zone just past the seam weighs as much as one as close inside
+	points := []controlPoint{{[2]float64{5, 150}, [4]float64{10}}, {[2]float64{150, 150}, [4]float64{30}}}
+	if value := s.interpolate(points, 0, [2]float64{295, 150}, 0); value > 11 {
+		t.Errorf("interpolated %g next to a zone across the seam, want close to 10", value)
+	}
+}
@@ -0,0 +1,214 @@
+package engine
+
+import "math"
+
+const (
+	predatorPerception  = 80.0 // Distance at which a predator sees birds
+	predatorPatrolSpeed = 0.8
+	predatorChaseSpeed  = 1.6
+	predatorMaxForce    = 0.2
+	predatorWander      = 0.3  // Largest turn of a patrolling predator per tick, radians
+	maxInterceptTime    = 30.0 // Ticks ahead a predator aims when intercepting
+	isolationRadius     = 15.0 // Birds closer than this to a bird shield it
+
+	predatorMaxEnergy   = 100.0
+	predatorPatrolCost  = 0.02 // Energy per tick
+	predatorChaseCost   = 0.08 // Energy per tick
+	killEnergy          = 50.0
+	digestionRate       = 1.0 / 300 // Satiety lost per tick; predators rest while sated
+	satedSatiety        = 0.5       // Above this a predator rests rather than hunts
+	predatorBirthEnergy = 90.0      // A predator with more energy breeds
+	birdsPerPredator    = 50        // Prey needed to support each predator
+	predatorImmigration = 0.001     // Chance per tick that a predator arrives in a world without any
+)
+
+// updatePredators moves the predators and resolves their attacks. Hungry
+// predators patrol until they see birds, pick the most isolated one close
+// by, as birds in a flock are safer, and chase it with interception
+// steering. A kill feeds them and they rest while digesting. Predators
+// starve when their energy runs out and breed when well fed, while there
+// is prey enough, so their number follows the prey. birds indexes the
+// current bird positions.
+func (s *Simulation) updatePredators(birds *spatialIndex) {
+	for i := range s.state.Predators {
+		predator := &s.state.Predators[i]
+		predator.Satiety = math.Max(0, predator.Satiety-digestionRate)
+
+		switch {
+		case predator.Satiety > satedSatiety:
+			predator.State = "resting"
+			predator.Target = -1
+			predator.Velocity = [2]float64{}
+		case predator.State == "hunting":
+			if target := s.findPredatorTarget(predator, birds); target >= 0 {
+				s.chase(predator, &s.state.Birds[target])
+				break
+			}
+			predator.State = "patrolling"
+			predator.Target = -1
+			fallthrough
+		default:
+			predator.State = "patrolling"
+			if target := s.choosePrey(predator, birds); target >= 0 {
+				predator.State = "hunting"
+				predator.Target = s.state.Birds[target].ID
+				s.chase(predator, &s.state.Birds[target])
+			} else {
+				s.patrol(predator)
+			}
+		}
+
+		s.movePredator(predator)
+		s.attack(predator, birds)
+	}
+	s.regulatePredators()
+}
+
+// findPredatorTarget returns the index of the bird predator is chasing if it
+// still sees it, or -1.
+func (s *Simulation) findPredatorTarget(predator *Predator, birds *spatialIndex) int {
+	found := -1
+	birds.query(predator.Position, predatorPerception, func(j int) {
+		if s.state.Birds[j].ID == predator.Target && s.state.Birds[j].State != "dead" {
+			found = j
+		}
+	})
+	return found
+}
+
+// choosePrey returns the index of the bird predator should chase, or -1 if
+// it sees none. Birds with fewer neighbours score better, then closer ones.
+func (s *Simulation) choosePrey(predator *Predator, birds *spatialIndex) int {
+	best, bestScore := -1, math.MaxFloat64
+	birds.query(predator.Position, predatorPerception, func(j int) {
+		bird := &s.state.Birds[j]
+		if bird.State == "dead" {
+			return
+		}
+		neighbours := 0
+		birds.query(bird.Position, isolationRadius, func(k int) {
+			if k != j && s.state.Birds[k].State != "dead" {
+				neighbours++
+			}
+		})
+		score := float64(neighbours) + s.dist(predator.Position, bird.Position)/predatorPerception
+		if score < bestScore {
+			best, bestScore = j, score
+		}
+	})
+	return best
+}
+
+// chase steers predator towards the point where it would meet bird if the
+// bird kept its velocity.
+func (s *Simulation) chase(predator *Predator, bird *Bird) {
+	dist := s.dist(predator.Position, bird.Position)
+	lead := math.Min(dist/predatorChaseSpeed, maxInterceptTime) * float64(s.timeStep)
+	aim := [2]float64{bird.Position[0] + bird.Velocity[0]*lead, bird.Position[1] + bird.Velocity[1]*lead}
+	force := limit(steer(predator.Velocity, s.offset(predator.Position, aim), predatorChaseSpeed), predatorMaxForce)
+	predator.Velocity = limit([2]float64{predator.Velocity[0] + force[0], predator.Velocity[1] + force[1]}, predatorChaseSpeed)
+	predator.Energy -= predatorChaseCost * windEnergyRatio(predator.Velocity, s.windAt(predator.Position))
+}
+
+// patrol makes predator wander at patrol speed.
+func (s *Simulation) patrol(predator *Predator) {
+	heading := math.Atan2(predator.Velocity[1], predator.Velocity[0])
+	if predator.Velocity == [2]float64{} {
+		heading = s.rng.Float64() * 2 * math.Pi
+	}
+	heading += (s.rng.Float64()*2 - 1) * predatorWander
+	predator.Velocity = [2]float64{math.Cos(heading) * predatorPatrolSpeed, math.Sin(heading) * predatorPatrolSpeed}
+	predator.Energy -= predatorPatrolCost * windEnergyRatio(predator.Velocity, s.windAt(predator.Position))
+}
+
+// movePredator moves predator along its velocity, drifting with the wind.
+// Predators wrap around a torus and turn back at the edges of any other
+// world, open ones included.
+func (s *Simulation) movePredator(predator *Predator) {
+	worldSize := float64(s.config.WorldSize)
+	predator.Velocity = s.repel(predator.Position, predator.Velocity)
+	wind := s.windAt(predator.Position)
+	for axis := 0; axis < 2; axis++ {
+		predator.Position[axis] += (predator.Velocity[axis] + wind[axis]) * float64(s.timeStep)
+		if s.boundary() != torusBoundary && (predator.Position[axis] < 0 || predator.Position[axis] > worldSize) {
+			predator.Position[axis] = math.Max(0, math.Min(worldSize, predator.Position[axis]))
+			predator.Velocity[axis] = -predator.Velocity[axis]
+		}
+	}
+	predator.Position = s.keepInside(predator.Position)
+}
+
+// attack makes the birds close to predator flee, and lets a hunting
+// predator catch its target. Fast birds are harder to catch; risk averse
+// birds flee from up to twice the attack radius.
+func (s *Simulation) attack(predator *Predator, birds *spatialIndex) {
+	birds.query(predator.Position, 2*predatorAttackRadius, func(j int) {
+		bird := &s.state.Birds[j]
+		dist := s.dist(predator.Position, bird.Position)
+		if bird.State == "dead" || dist >= predatorAttackRadius*(1+bird.Genome.RiskAversion) {
+			return
+		}
+		vulnerability := s.speciesOf(bird).PredatorVulnerability / bird.Genome.Speed
+		if predator.State == "hunting" && bird.ID == predator.Target && dist < predatorAttackRadius &&
+			s.config.CaptureProbability > 0 && s.rng.Float64() < s.config.CaptureProbability*vulnerability {
+			s.kill(bird, killedByPredator)
+			predator.Energy = math.Min(predatorMaxEnergy, predator.Energy+killEnergy)
+			predator.Satiety = 1
+			predator.State = "resting"
+			predator.Target = -1
+			return
+		}
+		// Bird tries to escape by moving towards the nearest group
+		closestGroupPos := s.findClosestGroup(bird)
+		bird.Target = closestGroupPos
+		bird.State = "migrating"
+	})
+}
+
+// regulatePredators removes the predators that starved and lets well fed
+// ones breed while the prey can support more predators.
+func (s *Simulation) regulatePredators() {
+	prey := 0
+	for i := range s.state.Birds {
+		if s.state.Birds[i].State != "dead" {
+			prey++
+		}
+	}
+	capacity := prey / birdsPerPredator
+
+	alive := s.state.Predators[:0]
+	for _, predator := range s.state.Predators {
+		if predator.Energy > 0 {
+			alive = append(alive, predator)
+		}
+	}
+	clear(s.state.Predators[len(alive):])
+	s.state.Predators = alive
+
+	for i := 0; i < len(s.state.Predators) && len(s.state.Predators) < capacity; i++ {
+		parent := &s.state.Predators[i]
+		if parent.Energy < predatorBirthEnergy {
+			continue
+		}
+		parent.Energy /= 2
+		s.state.Predators = append(s.state.Predators, s.newPredator(parent.Position, parent.Energy))
+	}
+
+	// Predators come back from outside to a world that lost them all
+	if len(s.state.Predators) == 0 && capacity > 0 && s.rng.Float64() < predatorImmigration {
+		s.state.Predators = append(s.state.Predators, s.newPredator(s.randomPosition(), predatorMaxEnergy/2))
+	}
+}
+
+func (s *Simulation) newPredator(position [2]float64, energy float64) Predator {
+	predator := Predator{
+		ID:       s.nextPredatorID,
+		Position: position,
+		Velocity: [2]float64{s.rng.Float64() - 0.5, s.rng.Float64() - 0.5},
+		State:    "patrolling",
+		Target:   -1,
+		Energy:   energy,
+	}
+	s.nextPredatorID++
+	return predator
+}
@@ -0,0 +1,47 @@
+package engine
+
+// randSource is the part of *rand.Rand the behaviors draw from, so that they
+// can run on either the simulation RNG or an agent stream.
+type randSource interface {
+	Float64() float64
+}
+
+// agentRand is a small random stream private to one agent for one tick. It is
+// derived from the run seed, the tick and the agent ID only, so draws do not
+// depend on which worker updates the agent or in which order.
+type agentRand struct {
+	state uint64
+}
+
+// Salts separating the streams an agent uses in different phases of a tick
+const (
+	saltDecide uint64 = iota + 1
+	saltEat
+	saltWind
+	saltTerrain
+)
+
+func newAgentRand(seed int64, tick, id int, salt uint64) *agentRand {
+	return &agentRand{state: mix64(mix64(uint64(seed)^salt<<56) ^ uint64(tick)<<24 ^ uint64(id))}
+}
+
+func (r *agentRand) Uint64() uint64 {
+	r.state += 0x9e3779b97f4a7c15
+	return mix64(r.state)
+}
+
+func (r *agentRand) Float64() float64 {
+	return float64(r.Uint64()>>11) / (1 << 53)
+}
+
+// mix64 is the SplitMix64 finalizer.
+func mix64(z uint64) uint64 {
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// restoreSeed derives the random source seed of a run restored at tick.
+func restoreSeed(seed int64, tick int) int64 {
+	return int64(mix64(uint64(seed) + uint64(tick)*0x9e3779b97f4a7c15))
+}
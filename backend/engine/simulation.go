@@ -0,0 +1,466 @@
+package engine
+
+import (
+	"math/rand"
+	"reflect"
+	"time"
+)
+
+const collisionThreshold = 2.0 // Distance threshold for collision detection
+const predatorAttackRadius = 10.0
+
+const birdIndexCellSize = 10.0 // Spatial index resolution for bird neighbourhood queries
+const minParallelItems = 512   // Below this, updating birds on several goroutines costs more than it saves
+
+// Simulation owns a migration world: its state, its configuration and its
+// random source. It is not safe for concurrent use; callers are expected to
+// drive it from a single goroutine.
+type Simulation struct {
+	state    SimulationState
+	config   SimulationConfig
+	env      EnvironmentalFactors
+	rng      *rand.Rand
+	seed     int64
+	running  bool
+	timeStep int
+
+	currentFoodLocation [2]float64
+	foodRegion          int
+
+	// Per-tick caches, rebuilt when what they index changes
+	birdIndex      *spatialIndex
+	resourceIndex  *spatialIndex
+	zoneIndex      *spatialIndex
+	environment    *environmentLayers
+	terrain        *raster
+	ground         *raster // Ground level, structures included, for birds looking ahead
+	groupCentroids [][2]float64
+
+	nextBirdID     int
+	nextPredatorID int
+	species        map[string]*Species // Species of the mix by name
+	windNoise      *perlin
+}
+
+// New creates a simulation from the given configuration and environment and
+// populates its world.
+func New(config SimulationConfig, env EnvironmentalFactors) *Simulation {
+	s := &Simulation{
+		config:   config.Clone(),
+		env:      env,
+		timeStep: 1,
+	}
+	s.Reset()
+	return s
+}
+
+// Reset regenerates the world from the current configuration.
+func (s *Simulation) Reset() {
+	s.config.Flocking = s.config.Flocking.withDefaults()
+	s.normalizeSpecies()
+	s.seed = s.config.Seed
+	if s.seed == 0 {
+		s.seed = time.Now().UnixNano()
+	}
+	s.rng = rand.New(rand.NewSource(s.seed))
+	s.windNoise = newPerlin(s.seed, saltWind)
+	s.state = SimulationState{Seed: s.seed}
+	s.state.Birds = make([]Bird, s.config.InitialBirds)
+
+	// Generate obstacles
+	s.state.Obstacles = make([]Obstacle, s.config.ObstacleCount)
+	for i := range s.state.Obstacles {
+		radius := s.rng.Float64()*15 + 5
+		s.state.Obstacles[i] = Obstacle{
+			ID:       i,
+			Shape:    circleShape,
+			Position: s.randomPosition(),
+			Radius:   radius,
+			Height:   mountainHeight * radius,
+		}
+	}
+	for _, obstacle := range cloneObstacles(s.config.Obstacles) {
+		obstacle.ID = len(s.state.Obstacles)
+		if obstacle.structure() {
+			placeStructure(&obstacle)
+		}
+		s.state.Obstacles = append(s.state.Obstacles, obstacle)
+	}
+
+	// Ensure the number of resources is at least one-third of the number of birds
+	resourceCount := s.config.ResourceCount
+	if resourceCount < s.config.InitialBirds/3 {
+		resourceCount = s.config.InitialBirds / 3
+	}
+
+	// Generate resources. Food resources are spread over the diets of the
+	// species.
+	diets := s.diets()
+	s.state.Resources = make([]Resource, resourceCount) // Decrease the number of resources
+	for i := range s.state.Resources {
+		resourceType := diets[(i/2)%len(diets)]
+		if i%2 == 0 {
+			resourceType = "rest"
+		}
+		s.state.Resources[i] = Resource{
+			ID:       i + 1, // 0 is the main food location
+			Position: s.randomPosition(),
+			Type:     resourceType,
+			Capacity: 5, // Decrease the capacity of resources
+			Current:  5,
+		}
+	}
+
+	numGroups := s.config.InitialBirds / 10
+	if numGroups < 1 {
+		numGroups = 1
+	}
+	// Groups never mix species
+	species := make([]int, s.config.InitialBirds)
+	groups := make([]int, s.config.InitialBirds)
+	for i := range s.state.Birds {
+		species[i] = s.initialSpecies(i, s.config.InitialBirds)
+		groups[i] = s.rng.Intn(numGroups)*len(s.config.Species) + species[i]
+	}
+
+	// Set one-third of the birds to "searchingFood" state and the rest to "migrating" state
+	for i := range s.state.Birds {
+		state := "migrating"
+		if i < s.config.InitialBirds/3 {
+			state = "searchingFood"
+		}
+		s.state.Birds[i] = Bird{
+			ID:       i,
+			Position: s.randomPosition(),
+			Velocity: [2]float64{s.rng.Float64() - 0.5, s.rng.Float64()*2 - 1},
+			State:    state,
+			Target:   s.randomPosition(),
+			Group:    groups[i],
+			Species:  s.config.Species[species[i]].Name,
+			Energy:   maxEnergy/2 + s.rng.Float64()*maxEnergy/2,
+			Fatigue:  s.rng.Float64() * tiredFatigue / 2,
+			// The initial birds are adults of all ages short of old age
+			Age:              s.maturityAge() + s.rng.Intn(s.senescenceAge()-s.maturityAge()),
+			LastBreedingYear: -1,
+			Genome:           s.founderGenome(&s.config.Species[species[i]].Species),
+		}
+	}
+
+	// Generate predators
+	s.nextPredatorID = 0
+	s.state.Predators = make([]Predator, s.predatorCount())
+	for i := range s.state.Predators {
+		s.state.Predators[i] = s.newPredator(s.randomPosition(), predatorMaxEnergy/2)
+	}
+
+	// Generate initial food location on one side
+	s.foodRegion = 0
+	s.currentFoodLocation = s.generateFoodLocation(s.foodRegion)
+	s.placeFood()
+
+	// Generate zones
+	worldSize := float64(s.config.WorldSize)
+	s.state.Zones = []Zone{
+		{ID: 0, Position: [2]float64{worldSize / 4, worldSize / 4}, Temperature: 15.0, FoodAvailability: 1.0, PredatorPresence: 0.1, SeasonalAmplitude: 8, Role: "breeding"},
+		{ID: 1, Position: [2]float64{3 * worldSize / 4, worldSize / 4}, Temperature: 25.0, FoodAvailability: 0.8, PredatorPresence: 0.2, SeasonalAmplitude: 3, Role: "wintering"},
+		{ID: 2, Position: [2]float64{worldSize / 4, 3 * worldSize / 4}, Temperature: 10.0, FoodAvailability: 0.5, PredatorPresence: 0.3, SeasonalAmplitude: 10, Role: "breeding"},
+		{ID: 3, Position: [2]float64{3 * worldSize / 4, 3 * worldSize / 4}, Temperature: 20.0, FoodAvailability: 0.9, PredatorPresence: 0.1, SeasonalAmplitude: 4, Role: "wintering"},
+	}
+
+	// Generate initial food location in the best zone
+	if bestZone, ok := s.findBestZone(); ok {
+		s.currentFoodLocation = s.generateFoodLocation(bestZone.ID)
+	}
+	s.placeFood()
+
+	s.invalidateIndexes()
+	// Birds start on the ground, outside buildings
+	for i := range s.state.Birds {
+		bird := &s.state.Birds[i]
+		bird.Position = s.outsideStructures(bird.Position)
+		bird.Altitude = s.groundLevel(bird.Position)
+	}
+	s.state.Time = 0
+	s.updateCalendar()
+	s.state.WorldSize = s.config.WorldSize
+	s.state.Population = Population{}
+	s.countPopulation()
+	s.nextBirdID = len(s.state.Birds)
+	s.running = true
+	s.state.IsRunning = s.running
+}
+
+// Step advances the world by one tick.
+func (s *Simulation) Step() {
+	s.update()
+	s.detectCollisions()
+	s.removeDead()
+	s.breed()
+}
+
+// Snapshot returns a copy of the current state that is safe to hand to
+// other goroutines.
+func (s *Simulation) Snapshot() SimulationState {
+	return s.state.Clone()
+}
+
+func (s *Simulation) Start() {
+	s.running = true
+	s.state.IsRunning = s.running
+}
+
+func (s *Simulation) Stop() {
+	s.running = false
+	s.state.IsRunning = s.running
+}
+
+func (s *Simulation) Running() bool {
+	return s.running
+}
+
+func (s *Simulation) Config() SimulationConfig {
+	return s.config.Clone()
+}
+
+// SetConfig replaces the configuration and regenerates the world.
+func (s *Simulation) SetConfig(config SimulationConfig) {
+	s.config = config.Clone()
+	s.Reset()
+}
+
+// UpdateConfig replaces the configuration, regenerating the world only if a
+// field that shapes it changed. It reports whether the world was regenerated.
+func (s *Simulation) UpdateConfig(config SimulationConfig) bool {
+	if !reflect.DeepEqual(worldShaping(s.config), worldShaping(config)) {
+		s.SetConfig(config)
+		return true
+	}
+	flocking := s.config.Flocking
+	s.config = config.Clone()
+	s.config.Flocking = s.config.Flocking.withDefaults()
+	s.followFlocking(flocking)
+	s.normalizeSpecies()
+	return false
+}
+
+// worldShaping returns config without the fields that take effect on the
+// next tick: the speed, the workers, the flocking parameters and the rates
+// of the events of the run.
+func worldShaping(config SimulationConfig) SimulationConfig {
+	config.SimulationSpeed = 0
+	config.Flocking = FlockingConfig{}
+	config.Workers = 0
+	config.CaptureProbability = 0
+	config.CollisionMortality = 0
+	config.CarryingCapacity = 0
+	config.MutationRate = 0
+	config.MutationScale = 0
+	return config
+}
+
+func (s *Simulation) Environment() EnvironmentalFactors {
+	return s.env
+}
+
+// SetEnvironment replaces the environmental factors and regenerates the
+// world so that the number of predators follows the new presence.
+func (s *Simulation) SetEnvironment(env EnvironmentalFactors) {
+	s.env = env
+	s.Reset()
+}
+
+// UpdateEnvironment replaces the environmental factors without regenerating
+// the world. The temperature, food availability and wind change what birds
+// sense from the next tick on; a new predator presence adds or removes
+// predators to match it, and is sensed where no zone sets one.
+func (s *Simulation) UpdateEnvironment(env EnvironmentalFactors) {
+	changed := env.PredatorPresence != s.env.PredatorPresence
+	s.env = env
+	if changed {
+		s.adjustPredators()
+		s.environment = nil
+	}
+}
+
+// predatorCount returns the number of predators the predator presence calls
+// for, at least one.
+func (s *Simulation) predatorCount() int {
+	return max(int(s.env.PredatorPresence*10), 1)
+}
+
+// adjustPredators brings the number of predators to predatorCount, placing
+// new ones at random and removing the most recent first.
+func (s *Simulation) adjustPredators() {
+	count := s.predatorCount()
+	if len(s.state.Predators) > count {
+		s.state.Predators = s.state.Predators[:count]
+	}
+	for len(s.state.Predators) < count {
+		s.state.Predators = append(s.state.Predators, s.newPredator(s.randomPosition(), predatorMaxEnergy/2))
+	}
+}
+
+func (s *Simulation) TimeStep() int {
+	return s.timeStep
+}
+
+func (s *Simulation) SetTimeStep(timeStep int) {
+	s.timeStep = timeStep
+}
+
+// Speed returns the number of milliseconds between two ticks, zero to tick as
+// fast as possible.
+func (s *Simulation) Speed() int {
+	return s.config.SimulationSpeed
+}
+
+// SetSpeed changes the number of milliseconds between two ticks without
+// regenerating the world.
+func (s *Simulation) SetSpeed(speed int) {
+	s.config.SimulationSpeed = speed
+}
+
+// SetZones replaces the zones. No zones are kept as an empty list, so that
+// the state never reports them as null.
+func (s *Simulation) SetZones(zones []Zone) {
+	s.state.Zones = append([]Zone{}, zones...)
+	s.zoneIndex = nil
+	s.environment = nil
+}
+
+// SetTemperatureZones replaces the temperature zones, placing them at the
+// centre of their region.
+func (s *Simulation) SetTemperatureZones(zones []TemperatureZone) {
+	zones = append([]TemperatureZone{}, zones...)
+	for i := range zones {
+		zones[i].Position = s.temperatureZonePosition(zones[i])
+	}
+	s.state.TemperatureZones = zones
+	s.environment = nil
+}
+
+// Seed returns the seed the current run was generated from.
+func (s *Simulation) Seed() int64 {
+	return s.seed
+}
+
+// Restore replaces the world with a previously saved state. The simulation is
+// left stopped. The random source is reseeded from the saved seed and tick so
+// that a restored run is itself reproducible.
+func (s *Simulation) Restore(state SimulationState, config SimulationConfig) {
+	s.state = state.Clone()
+	s.config = config.Clone()
+	s.config.Flocking = s.config.Flocking.withDefaults()
+	s.normalizeSpecies()
+	s.seed = state.Seed
+	s.rng = rand.New(rand.NewSource(restoreSeed(state.Seed, state.Time)))
+	s.windNoise = newPerlin(s.seed, saltWind)
+	// States saved before deaths were tracked have no population, nor
+	// calendar
+	s.countPopulation()
+	s.updateCalendar()
+	s.nextBirdID = 0
+	for i := range s.state.Birds {
+		bird := &s.state.Birds[i]
+		s.nextBirdID = max(s.nextBirdID, bird.ID+1)
+		// Birds saved before genomes existed get the default one
+		if bird.Genome == (Genome{}) {
+			bird.Genome = s.defaultGenome()
+		}
+	}
+	// Mountains saved before the terrain existed get the default height
+	for i := range s.state.Obstacles {
+		if !s.state.Obstacles[i].structure() && s.state.Obstacles[i].Height == 0 {
+			s.state.Obstacles[i].Height = mountainHeight * s.state.Obstacles[i].Radius
+		}
+	}
+	s.nextPredatorID = 0
+	for i := range s.state.Predators {
+		predator := &s.state.Predators[i]
+		s.nextPredatorID = max(s.nextPredatorID, predator.ID+1)
+		// Predators saved before they had a behavior start patrolling
+		if predator.State == "" {
+			predator.State = "patrolling"
+			predator.Target = -1
+			predator.Energy = predatorMaxEnergy / 2
+		}
+	}
+	// The main food resource is the first one; birds keep heading for it
+	if len(s.state.Resources) > 0 && s.state.Resources[0].ID == 0 {
+		s.currentFoodLocation = s.state.Resources[0].Position
+	}
+	s.invalidateIndexes()
+	s.running = false
+	s.state.IsRunning = s.running
+}
+
+func (s *Simulation) invalidateIndexes() {
+	s.birdIndex = nil
+	s.resourceIndex = nil
+	s.zoneIndex = nil
+	s.environment = nil
+	s.terrain = nil
+	s.ground = nil
+}
+
+func (s *Simulation) randomPosition() [2]float64 {
+	return s.randomPositionFrom(s.rng)
+}
+
+func (s *Simulation) randomPositionFrom(rng randSource) [2]float64 {
+	return [2]float64{rng.Float64() * float64(s.config.WorldSize), rng.Float64() * float64(s.config.WorldSize)}
+}
+
+// placeFood puts the main food resource at the current food location. It is
+// always the first resource, ahead of the scattered food and rest sites.
+func (s *Simulation) placeFood() {
+	food := s.newFoodResource()
+	if len(s.state.Resources) > 0 && s.state.Resources[0].ID == food.ID {
+		s.state.Resources[0] = food
+	} else {
+		s.state.Resources = append([]Resource{food}, s.state.Resources...)
+	}
+	s.resourceIndex = nil
+}
+
+func (s *Simulation) newFoodResource() Resource {
+	return Resource{
+		ID:       0,
+		Position: s.currentFoodLocation,
+		Type:     s.diets()[0],
+		Capacity: 5,
+		Current:  5,
+	}
+}
+
+func (s *Simulation) generateFoodLocation(region int) [2]float64 {
+	var xOffset, yOffset float64
+	worldSize := float64(s.config.WorldSize)
+	switch region {
+	case 0:
+		xOffset, yOffset = 0, 0
+	case 1:
+		xOffset, yOffset = worldSize/2, 0
+	case 2:
+		xOffset, yOffset = 0, worldSize/2
+	case 3:
+		xOffset, yOffset = worldSize/2, worldSize/2
+	}
+	return [2]float64{xOffset + s.rng.Float64()*worldSize/2, yOffset + s.rng.Float64()*worldSize/2}
+}
+
+// findBestZone returns the zone with the most food among those at a
+// comfortable temperature, or the first zone if none is. It reports false
+// when there are no zones.
+func (s *Simulation) findBestZone() (Zone, bool) {
+	if len(s.state.Zones) == 0 {
+		return Zone{}, false
+	}
+	bestZone := s.state.Zones[0]
+	for _, zone := range s.state.Zones {
+		if temperature := s.zoneTemperature(zone); temperature > 10.0 && temperature < 25.0 && zone.FoodAvailability > bestZone.FoodAvailability {
+			bestZone = zone
+		}
+	}
+	return bestZone, true
+}
@@ -0,0 +1,83 @@
+package engine
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// New flocking weights keep the world and carry over to the species that
+// follow them and to their birds, whose genes steer the flock.
+func TestUpdateFlockingKeepsWorld(t *testing.T) {
+	s := New(SimulationConfig{WorldSize: 400, InitialBirds: 30, Seed: 1}, EnvironmentalFactors{Temperature: 20, FoodAvailability: 1})
+	before := s.Snapshot()
+
+	config := s.Config()
+	config.Flocking.CohesionWeight *= 2
+	if s.UpdateConfig(config) {
+		t.Fatal("new flocking parameters regenerated the world")
+	}
+	after := s.Snapshot()
+	if len(after.Birds) != len(before.Birds) || after.Time != before.Time {
+		t.Fatal("new flocking parameters changed the world")
+	}
+	if got, want := s.Config().Species[0].CohesionWeight, 2*DefaultFlocking.CohesionWeight; got != want {
+		t.Errorf("species cohesion weight %g, want %g", got, want)
+	}
+	if s.speciesOf(&after.Birds[0]).CohesionWeight != 2*DefaultFlocking.CohesionWeight {
+		t.Error("birds still see the old species")
+	}
+	for i, bird := range after.Birds {
+		old := before.Birds[i].Genome
+		if want := min(2*old.CohesionWeight, 5); math.Abs(bird.Genome.CohesionWeight-want) > 1e-9 {
+			t.Fatalf("bird %d cohesion gene %g, want %g", bird.ID, bird.Genome.CohesionWeight, want)
+		}
+		if bird.Genome.SeparationWeight != old.SeparationWeight {
+			t.Fatalf("bird %d separation gene changed", bird.ID)
+		}
+	}
+}
+
+// run steps a new simulation ticks times, changing the environment and the
+// zones halfway through.
+func run(config SimulationConfig, ticks int) SimulationState {
+	env := EnvironmentalFactors{Temperature: 20, FoodAvailability: 1, PredatorPresence: 0.3}
+	s := New(config, env)
+	s.Start()
+	for tick := 0; tick < ticks; tick++ {
+		if tick == ticks/2 {
+			env.Temperature = 12
+			env.PredatorPresence = 0.5
+			s.UpdateEnvironment(env)
+			s.SetZones([]Zone{
+				{ID: 0, Position: [2]float64{100, 100}, Temperature: 14, FoodAvailability: 1},
+				{ID: 1, Position: [2]float64{300, 300}, Temperature: 24, FoodAvailability: 0.7},
+			})
+		}
+		s.Step()
+	}
+	return s.Snapshot()
+}
+
+// The same seed, configuration and commands give the same run.
+func TestSeededRunsAreIdentical(t *testing.T) {
+	config := SimulationConfig{WorldSize: 400, InitialBirds: 60, ObstacleCount: 3, ResourceCount: 10, Seed: 42}
+	first, second := run(config, 60), run(config, 60)
+	if !reflect.DeepEqual(first, second) {
+		t.Fatal("two runs with the same seed diverged")
+	}
+	config.Seed = 43
+	if reflect.DeepEqual(first, run(config, 60)) {
+		t.Fatal("two runs with different seeds are identical")
+	}
+}
+
+// Results do not depend on the number of workers birds are updated on.
+func TestWorkersDoNotChangeResults(t *testing.T) {
+	config := SimulationConfig{WorldSize: 600, InitialBirds: 2 * minParallelItems, ObstacleCount: 3, ResourceCount: 10, Seed: 7, Workers: 1}
+	serial := run(config, 30)
+	config.Workers = 8
+	if !reflect.DeepEqual(serial, run(config, 30)) {
+		t.Fatal("a run on 8 workers diverged from the same run on 1")
+	}
+}
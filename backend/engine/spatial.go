@@ -0,0 +1,192 @@
+package engine
+
+import "math"
+
+// maxIndexCells bounds the memory used by a spatial index on large worlds.
+const maxIndexCells = 1 << 20
+
+// spatialIndex is a uniform grid over a set of points, built once and
+// discarded when the points move. Queries visit cells in row-major order and
+// points in index order, so results only depend on the input. On a world
+// that wraps around, queries wrap around too and measure distances the
+// shortest way.
+type spatialIndex struct {
+	cellSize   float64
+	cols, rows int
+	period     float64 // Size of a world that wraps around, zero otherwise
+	points     [][2]float64
+	cellStart  []int32 // Points of cell c are items[cellStart[c]:cellStart[c+1]]
+	items      []int32
+}
+
+func newSpatialIndex(points [][2]float64, worldSize, cellSize float64, wrap bool) *spatialIndex {
+	if worldSize <= 0 {
+		worldSize = 1
+	}
+	if cellSize <= 0 {
+		cellSize = worldSize
+	}
+	cols := int(math.Ceil(worldSize / cellSize))
+	if cols*cols > maxIndexCells {
+		cols = int(math.Sqrt(maxIndexCells))
+		cellSize = worldSize / float64(cols)
+	}
+	if cols < 1 {
+		cols = 1
+	}
+	var period float64
+	if wrap {
+		// Cells tile the world exactly, so that they are the same size
+		// across the seam
+		cellSize = worldSize / float64(cols)
+		period = worldSize
+	}
+
+	g := &spatialIndex{
+		cellSize:  cellSize,
+		cols:      cols,
+		rows:      cols,
+		period:    period,
+		points:    points,
+		cellStart: make([]int32, cols*cols+1),
+		items:     make([]int32, len(points)),
+	}
+
+	// Counting sort of the points by cell
+	for _, p := range points {
+		g.cellStart[g.cellOf(p)+1]++
+	}
+	for c := 1; c < len(g.cellStart); c++ {
+		g.cellStart[c] += g.cellStart[c-1]
+	}
+	next := make([]int32, len(g.cellStart)-1)
+	copy(next, g.cellStart)
+	for i, p := range points {
+		c := g.cellOf(p)
+		g.items[next[c]] = int32(i)
+		next[c]++
+	}
+	return g
+}
+
+func (g *spatialIndex) coords(p [2]float64) (int, int) {
+	cx := int(math.Floor(p[0] / g.cellSize))
+	cy := int(math.Floor(p[1] / g.cellSize))
+	return clampInt(cx, 0, g.cols-1), clampInt(cy, 0, g.rows-1)
+}
+
+func (g *spatialIndex) cellOf(p [2]float64) int {
+	cx, cy := g.coords(p)
+	return cy*g.cols + cx
+}
+
+// query calls visit for every point within radius of center.
+func (g *spatialIndex) query(center [2]float64, radius float64, visit func(i int)) {
+	x0, y0 := g.coords([2]float64{center[0] - radius, center[1] - radius})
+	x1, y1 := g.coords([2]float64{center[0] + radius, center[1] + radius})
+	if g.period > 0 {
+		x0, x1 = g.span(center[0], radius, g.cols)
+		y0, y1 = g.span(center[1], radius, g.rows)
+	}
+	for cy := y0; cy <= y1; cy++ {
+		for cx := x0; cx <= x1; cx++ {
+			c := g.wrap(cy, g.rows)*g.cols + g.wrap(cx, g.cols)
+			for _, i := range g.items[g.cellStart[c]:g.cellStart[c+1]] {
+				if g.distance(center, g.points[i]) <= radius {
+					visit(int(i))
+				}
+			}
+		}
+	}
+}
+
+// span returns the range of cells, unwrapped, within radius of x on a world
+// that wraps around. The range never covers a cell twice.
+func (g *spatialIndex) span(x, radius float64, cells int) (int, int) {
+	lo := int(math.Floor((x - radius) / g.cellSize))
+	hi := int(math.Floor((x + radius) / g.cellSize))
+	if hi-lo+1 >= cells {
+		return 0, cells - 1
+	}
+	return lo, hi
+}
+
+// wrap returns cell c brought back into [0, cells) on a world that wraps
+// around.
+func (g *spatialIndex) wrap(c, cells int) int {
+	if g.period > 0 {
+		return ((c % cells) + cells) % cells
+	}
+	return c
+}
+
+// distance returns the distance between two points, the shortest way around
+// on a world that wraps around.
+func (g *spatialIndex) distance(a, b [2]float64) float64 {
+	offset := wrappedOffset(a, b, g.period)
+	return math.Hypot(offset[0], offset[1])
+}
+
+// nearest returns the closest point to center accepted by accept, searching
+// rings of cells outwards from the cell of center. It returns -1 if no point
+// is accepted.
+func (g *spatialIndex) nearest(center [2]float64, accept func(i int) bool) (int, float64) {
+	best, bestDist := -1, math.MaxFloat64
+	ccx, ccy := g.coords(center)
+	maxRing := max(g.cols, g.rows)
+	if g.period > 0 {
+		// Every cell is within half the world around
+		maxRing = maxRing/2 + 1
+	}
+	for ring := 0; ring <= maxRing; ring++ {
+		// Every point beyond this ring is at least ring cells away
+		if best >= 0 && bestDist <= float64(ring-1)*g.cellSize {
+			break
+		}
+		for cy := ccy - ring; cy <= ccy+ring; cy++ {
+			if g.period == 0 && (cy < 0 || cy >= g.rows) {
+				continue
+			}
+			// Only the border of the ring is new: whole rows at the top and
+			// bottom, the two end cells in between
+			step := 2 * ring
+			if cy == ccy-ring || cy == ccy+ring || ring == 0 {
+				step = 1
+			}
+			for cx := ccx - ring; cx <= ccx+ring; cx += step {
+				if g.period == 0 && (cx < 0 || cx >= g.cols) {
+					continue
+				}
+				// Cells met again around a small wrapping world are
+				// harmless: the same point is never closer the second time
+				c := g.wrap(cy, g.rows)*g.cols + g.wrap(cx, g.cols)
+				for _, i := range g.items[g.cellStart[c]:g.cellStart[c+1]] {
+					if !accept(int(i)) {
+						continue
+					}
+					dist := g.distance(center, g.points[i])
+					if dist < bestDist || (dist == bestDist && int(i) < best) {
+						best, bestDist = int(i), dist
+					}
+				}
+			}
+		}
+	}
+	return best, bestDist
+}
+
+// sparseCellSize sizes the cells of an index over a few points, such as
+// resources or zones, so that there is about one point per cell.
+func sparseCellSize(worldSize float64, n int) float64 {
+	return worldSize / math.Max(1, math.Ceil(math.Sqrt(float64(n))))
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
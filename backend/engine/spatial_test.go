@@ -0,0 +1,81 @@
+package engine
+
+import (
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// The index finds the same points as a scan of every point, across cell
+// borders and around the seam of a torus.
+func TestSpatialIndexMatchesScan(t *testing.T) {
+	tests := []struct {
+		name      string
+		worldSize float64
+		cellSize  float64
+		wrap      bool
+		points    int
+		margin    float64 // Points may lie this far outside the world
+	}{
+		{name: "dense", worldSize: 500, cellSize: 25, points: 2000},
+		{name: "sparse", worldSize: 500, cellSize: sparseCellSize(500, 7), points: 7},
+		{name: "one cell", worldSize: 100, cellSize: 0, points: 50},
+		{name: "open world", worldSize: 300, cellSize: 20, points: 500, margin: 40},
+		{name: "torus", worldSize: 400, cellSize: 30, wrap: true, points: 1500},
+		{name: "small torus", worldSize: 60, cellSize: 25, wrap: true, points: 40},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			coordinate := func() float64 {
+				// Some points lie exactly on cell borders
+				if test.cellSize > 0 && rng.Intn(10) == 0 {
+					return float64(rng.Intn(int(test.worldSize/test.cellSize)+1)) * test.cellSize
+				}
+				return rng.Float64()*(test.worldSize+2*test.margin) - test.margin
+			}
+			points := make([][2]float64, test.points)
+			for i := range points {
+				points[i] = [2]float64{coordinate(), coordinate()}
+			}
+			period := 0.0
+			if test.wrap {
+				period = test.worldSize
+			}
+			index := newSpatialIndex(points, test.worldSize, test.cellSize, test.wrap)
+			dist := func(a, b [2]float64) float64 {
+				offset := wrappedOffset(a, b, period)
+				return distance([2]float64{}, offset)
+			}
+
+			for q := 0; q < 200; q++ {
+				center := [2]float64{coordinate(), coordinate()}
+				radius := rng.Float64() * test.worldSize / 3
+
+				var got, want []int
+				index.query(center, radius, func(i int) { got = append(got, i) })
+				for i, p := range points {
+					if dist(center, p) <= radius {
+						want = append(want, i)
+					}
+				}
+				slices.Sort(got)
+				if !slices.Equal(got, want) {
+					t.Fatalf("query around %v within %g: %v, want %v", center, radius, got, want)
+				}
+
+				accept := func(i int) bool { return i%3 == q%3 }
+				nearest, nearestDist := index.nearest(center, accept)
+				best := -1
+				for i, p := range points {
+					if accept(i) && (best < 0 || dist(center, p) < dist(center, points[best])) {
+						best = i
+					}
+				}
+				if nearest != best {
+					t.Fatalf("nearest to %v: %d at %g, want %d at %g", center, nearest, nearestDist, best, dist(center, points[best]))
+				}
+			}
+		})
+	}
+}
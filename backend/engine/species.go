@@ -0,0 +1,171 @@
+package engine
+
+import (
+	"math"
+	"slices"
+)
+
+// Species holds the parameters shared by every bird of a kind. Speed and the
+// flocking weights seed the genome of the initial birds; the other
+// parameters apply to the whole species and are not inherited.
+type Species struct {
+	Name                  string   `json:"name"`
+	Speed                 float64  `json:"speed"` // Multiplier of the cruise speed
+	SeparationWeight      float64  `json:"separationWeight"`
+	AlignmentWeight       float64  `json:"alignmentWeight"`
+	CohesionWeight        float64  `json:"cohesionWeight"`
+	Diet                  []string `json:"diet"`                  // Resource types the species feeds on
+	PreferredTemperature  float64  `json:"preferredTemperature"`  // °C
+	TemperatureTolerance  float64  `json:"temperatureTolerance"`  // °C below the preferred temperature a bird stays in a zone
+	PredatorVulnerability float64  `json:"predatorVulnerability"` // Multiplier of the capture probability
+}
+
+// SpeciesShare is a species of the initial population and the fraction of
+// the initial birds that belong to it.
+type SpeciesShare struct {
+	Species
+	Share float64 `json:"share"`
+}
+
+// DefaultSpecies is the single species of runs that do not choose a mix.
+var DefaultSpecies = Species{
+	Name:                  "default",
+	Speed:                 1,
+	Diet:                  []string{"food"},
+	PreferredTemperature:  20,
+	TemperatureTolerance:  10,
+	PredatorVulnerability: 1,
+}
+
+// withDefaults fills the unset parameters of sp. The flocking weights are
+// taken from flocking when all of them are zero.
+func (sp Species) withDefaults(flocking FlockingConfig) Species {
+	if sp.Name == "" {
+		sp.Name = DefaultSpecies.Name
+	}
+	if sp.Speed <= 0 {
+		sp.Speed = DefaultSpecies.Speed
+	}
+	if sp.SeparationWeight == 0 && sp.AlignmentWeight == 0 && sp.CohesionWeight == 0 {
+		sp.SeparationWeight = flocking.SeparationWeight
+		sp.AlignmentWeight = flocking.AlignmentWeight
+		sp.CohesionWeight = flocking.CohesionWeight
+	}
+	if len(sp.Diet) == 0 {
+		sp.Diet = slices.Clone(DefaultSpecies.Diet)
+	}
+	if sp.TemperatureTolerance <= 0 {
+		sp.TemperatureTolerance = DefaultSpecies.TemperatureTolerance
+	}
+	if sp.PredatorVulnerability <= 0 {
+		sp.PredatorVulnerability = DefaultSpecies.PredatorVulnerability
+	}
+	return sp
+}
+
+// normalizeSpecies completes the species mix of the configuration, using the
+// default species when it is empty.
+func (s *Simulation) normalizeSpecies() {
+	if len(s.config.Species) == 0 {
+		s.config.Species = []SpeciesShare{{Species: DefaultSpecies, Share: 1}}
+	}
+	mix := make([]SpeciesShare, len(s.config.Species))
+	for i, share := range s.config.Species {
+		mix[i] = SpeciesShare{Species: share.Species.withDefaults(s.config.Flocking), Share: share.Share}
+	}
+	s.config.Species = mix
+
+	s.species = make(map[string]*Species, len(mix))
+	for i := range mix {
+		s.species[mix[i].Name] = &mix[i].Species
+	}
+}
+
+// followFlocking moves the species that took their flocking weights from
+// the old flocking parameters, and the genes of their living birds, to the
+// current ones. Genes are scaled so that birds keep their variation.
+func (s *Simulation) followFlocking(old FlockingConfig) {
+	current := s.config.Flocking
+	weights := func(sp *Species) [3]float64 {
+		return [3]float64{sp.SeparationWeight, sp.AlignmentWeight, sp.CohesionWeight}
+	}
+	from := [3]float64{old.SeparationWeight, old.AlignmentWeight, old.CohesionWeight}
+	to := [3]float64{current.SeparationWeight, current.AlignmentWeight, current.CohesionWeight}
+	if from == to {
+		return
+	}
+	following := make(map[string]bool)
+	for i := range s.config.Species {
+		sp := &s.config.Species[i].Species
+		if weights(sp) == from {
+			sp.SeparationWeight, sp.AlignmentWeight, sp.CohesionWeight = to[0], to[1], to[2]
+			following[sp.Name] = true
+		}
+	}
+	for i := range s.state.Birds {
+		bird := &s.state.Birds[i]
+		if !following[s.speciesOf(bird).Name] {
+			continue
+		}
+		for k, name := range [3]string{"separationWeight", "alignmentWeight", "cohesionWeight"} {
+			g := geneNamed(name)
+			value := g.value(&bird.Genome)
+			if from[k] > 0 {
+				*value *= to[k] / from[k]
+			} else {
+				*value = to[k]
+			}
+			*value = math.Max(g.lo, math.Min(g.hi, *value))
+		}
+	}
+}
+
+// speciesOf returns the species of bird. Birds of an unknown species, such
+// as birds saved before species existed, behave as the first species of
+// the mix.
+func (s *Simulation) speciesOf(bird *Bird) *Species {
+	if sp, ok := s.species[bird.Species]; ok {
+		return sp
+	}
+	return &s.config.Species[0].Species
+}
+
+// initialSpecies returns the index in the mix of the species of initial bird
+// i of n. Species get consecutive runs of birds in proportion to their
+// share.
+func (s *Simulation) initialSpecies(i, n int) int {
+	total := 0.0
+	for _, share := range s.config.Species {
+		total += max(share.Share, 0)
+	}
+	if total == 0 {
+		return i * len(s.config.Species) / n
+	}
+	position := (float64(i) + 0.5) / float64(n) * total
+	for k, share := range s.config.Species {
+		position -= max(share.Share, 0)
+		if position < 0 {
+			return k
+		}
+	}
+	return len(s.config.Species) - 1
+}
+
+// diets lists the resource types eaten by at least one species of the mix,
+// in mix order.
+func (s *Simulation) diets() []string {
+	var diets []string
+	for _, share := range s.config.Species {
+		for _, food := range share.Diet {
+			if !slices.Contains(diets, food) {
+				diets = append(diets, food)
+			}
+		}
+	}
+	return diets
+}
+
+// eats reports whether the species feeds on resources of the given type.
+func (sp *Species) eats(resourceType string) bool {
+	return slices.Contains(sp.Diet, resourceType)
+}
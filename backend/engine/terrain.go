@@ -0,0 +1,168 @@
+package engine
+
+import (
+	"math"
+	"slices"
+)
+
+const (
+	terrainCellSize = 5.0   // World units per cell of the generated heightmap
+	hillHeight      = 100.0 // Height of the rolling hills of the generated terrain
+	hillScale       = 0.2   // Size of the hills, relative to the world
+	mountainHeight  = 40.0  // Height of an obstacle mountain per unit of radius
+
+	cruiseClearance   = 50.0  // Height above the ground birds migrate at
+	maxFlightAltitude = 600.0 // Birds cannot fly higher
+	maxClimbRate      = 2.0   // Altitude gained per tick at most
+	maxDescentRate    = 4.0   // Altitude lost per tick at most
+	climbEnergyCost   = 0.005 // Energy per unit of altitude gained
+
+	routeLookahead = 40.0 // Distance ahead birds look at the terrain
+	routeSamples   = 3    // Points sampled along each way ahead
+	routeTurnCost  = 50.0 // Climb a bird would rather make than turn by a radian
+)
+
+// Turns, in radians, birds consider when looking for a way over the terrain,
+// from the slightest
+var routeTurns = [...]float64{0, -0.35, 0.35, -0.7, 0.7, -1.05, 1.05, -1.4, 1.4}
+
+// Heightmap gives the elevation of the ground on a grid of Cols by Rows cells
+// over the world, row by row from the origin.
+type Heightmap struct {
+	Cols    int       `json:"cols"`
+	Rows    int       `json:"rows"`
+	Heights []float64 `json:"heights"`
+}
+
+// Clone returns a copy of the heightmap that shares no slice with the
+// original.
+func (h *Heightmap) Clone() *Heightmap {
+	if h == nil {
+		return nil
+	}
+	clone := *h
+	clone.Heights = slices.Clone(h.Heights)
+	return &clone
+}
+
+// buildTerrain computes the elevation of the ground: the configured
+// heightmap, or rolling hills drawn from the run seed, with a mountain
+// raised on every obstacle.
+func (s *Simulation) buildTerrain() *raster {
+	worldSize := float64(s.config.WorldSize)
+	var terrain *raster
+	if h := s.config.Terrain; h != nil && h.Cols > 0 && h.Rows > 0 && len(h.Heights) == h.Cols*h.Rows {
+		terrain = newRaster(h.Cols, h.Rows, worldSize, slices.Clone(h.Heights))
+	} else {
+		cols := clampInt(int(math.Ceil(worldSize/terrainCellSize)), 1, maxEnvironmentResolution)
+		cell := worldSize / float64(cols)
+		scale := math.Max(worldSize*hillScale, 1)
+		noise := newPerlin(s.seed, saltTerrain)
+		values := make([]float64, cols*cols)
+		for row := 0; row < cols; row++ {
+			for col := 0; col < cols; col++ {
+				x, y := (float64(col)+0.5)*cell, (float64(row)+0.5)*cell
+				values[row*cols+col] = hillHeight * (noise.noise(x/scale, y/scale, 0) + 1) / 2
+			}
+		}
+		terrain = newRaster(cols, cols, worldSize, values)
+	}
+
+	// Obstacles are mountains as wide as their radius; structures stand on
+	// the terrain instead
+	for _, obstacle := range s.state.Obstacles {
+		if obstacle.structure() {
+			continue
+		}
+		height := obstacle.Height
+		if height == 0 {
+			height = mountainHeight * obstacle.Radius
+		}
+		sigma := math.Max(obstacle.Radius, 1)
+		for row := 0; row < terrain.rows; row++ {
+			y := (float64(row) + 0.5) * terrain.cellH
+			if math.Abs(y-obstacle.Position[1]) > 3*sigma {
+				continue
+			}
+			for col := 0; col < terrain.cols; col++ {
+				x := (float64(col) + 0.5) * terrain.cellW
+				d2 := (x-obstacle.Position[0])*(x-obstacle.Position[0]) + (y-obstacle.Position[1])*(y-obstacle.Position[1])
+				if d2 <= 9*sigma*sigma {
+					terrain.values[row*terrain.cols+col] += height * math.Exp(-d2/(2*sigma*sigma))
+				}
+			}
+		}
+	}
+	return terrain
+}
+
+// buildGround computes the ground level at the centre of cells about
+// terrainCellSize wide, so that birds can look ahead without sampling the
+// terrain and going through the structures at every point. The terrain must
+// be built first.
+func (s *Simulation) buildGround() *raster {
+	worldSize := float64(s.config.WorldSize)
+	cols := clampInt(int(math.Ceil(worldSize/terrainCellSize)), 1, maxEnvironmentResolution)
+	cell := worldSize / float64(cols)
+	values := make([]float64, cols*cols)
+	for row := 0; row < cols; row++ {
+		for col := 0; col < cols; col++ {
+			values[row*cols+col] = s.groundOver(s.terrain, [2]float64{(float64(col) + 0.5) * cell, (float64(row) + 0.5) * cell})
+		}
+	}
+	return newRaster(cols, cols, worldSize, values)
+}
+
+// elevation returns the height of the ground at pos.
+func (s *Simulation) elevation(pos [2]float64) float64 {
+	s.prepareIndexes()
+	return s.terrain.sample(pos)
+}
+
+// climb moves bird towards clearance above the ground under it, as fast as
+// it can climb or descend and never above the flight ceiling. Birds never
+// fly into the ground: they are lifted over what they could not avoid.
+func (s *Simulation) climb(bird *Bird, clearance float64) {
+	ground := s.groundLevel(bird.Position)
+	elapsed := float64(s.timeStep)
+	target := math.Min(ground+clearance, maxFlightAltitude)
+	change := math.Max(-maxDescentRate*elapsed, math.Min(maxClimbRate*elapsed, target-bird.Altitude))
+	bird.Altitude = math.Max(bird.Altitude+change, ground)
+}
+
+// route turns heading towards the cheapest way over the terrain ahead of
+// bird, looked at cell by cell. Birds weigh the climb each way needs against
+// how far it turns them, so they take passes rather than summits and go
+// around what rises above the flight ceiling. They steer clear of structures
+// that a ray cast along each candidate track, the heading at speed plus the
+// wind, would hit, and turn back if every way is blocked.
+func (s *Simulation) route(bird *Bird, heading [2]float64, speed float64) [2]float64 {
+	if heading == [2]float64{} {
+		return heading
+	}
+	s.prepareIndexes()
+	wind := s.windAt(bird.Position)
+	best, bestCost := [2]float64{-heading[0], -heading[1]}, math.MaxFloat64
+	for _, turn := range routeTurns {
+		// No way turning further can be cheaper than the best one found
+		if routeTurnCost*math.Abs(turn) >= bestCost {
+			break
+		}
+		cos, sin := math.Cos(turn), math.Sin(turn)
+		way := [2]float64{heading[0]*cos - heading[1]*sin, heading[0]*sin + heading[1]*cos}
+		peak := math.Inf(-1)
+		for step := 1; step <= routeSamples; step++ {
+			ahead := routeLookahead * float64(step) / routeSamples
+			peak = math.Max(peak, s.ground.cell(s.keepInside([2]float64{bird.Position[0] + way[0]*ahead, bird.Position[1] + way[1]*ahead})))
+		}
+		track := normalize([2]float64{way[0]*speed + wind[0], way[1]*speed + wind[1]})
+		if peak >= maxFlightAltitude || s.obstructed(bird, track) {
+			continue
+		}
+		cost := math.Max(0, peak+cruiseClearance-bird.Altitude) + routeTurnCost*math.Abs(turn)
+		if cost < bestCost {
+			best, bestCost = way, cost
+		}
+	}
+	return best
+}
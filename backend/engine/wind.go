@@ -0,0 +1,159 @@
+package engine
+
+import "math"
+
+const (
+	defaultWindPeriod  = 600
+	headwindEnergyCost = 1.0 // Relative extra flight cost per unit of headwind speed
+	minWindEnergyRatio = 0.5 // A tailwind saves at most this share of the flight cost
+	maxWindResolution  = 100 // Largest resolution of a sampled WindField
+)
+
+// windAt returns the wind blowing at pos on the current tick. It only reads
+// the simulation, so it may run concurrently for different birds.
+func (s *Simulation) windAt(pos [2]float64) [2]float64 {
+	wind := s.env.Wind
+	if wind.Speed == 0 {
+		return [2]float64{}
+	}
+	period := float64(wind.Period)
+	if period <= 0 {
+		period = defaultWindPeriod
+	}
+	t := float64(s.state.Time)
+
+	// The wind veers by up to a quarter turn each way and gusts over a period
+	phase := 2 * math.Pi * t / period
+	direction := wind.Direction * math.Pi / 180
+	heading := direction + wind.Variability*math.Pi/2*math.Sin(phase)
+	speed := wind.Speed * (1 + wind.Variability/2*math.Sin(2*phase+1))
+
+	switch wind.Mode {
+	case "uniform":
+	case "gradient":
+		// From calm on one side of the world to twice the mean speed on the
+		// other, across the mean direction
+		centre := float64(s.config.WorldSize) / 2
+		across := ((pos[0]-centre)*math.Sin(direction) - (pos[1]-centre)*math.Cos(direction)) / float64(max(s.config.WorldSize, 1))
+		speed *= math.Max(0, 1+2*across)
+	case "noise":
+		scale := wind.Scale
+		if scale <= 0 {
+			scale = float64(max(s.config.WorldSize, 1)) / 4
+		}
+		// Two independent noise fields bend and scale the wind, and drift
+		// with time
+		x, y, z := pos[0]/scale, pos[1]/scale, t/period
+		heading += math.Pi / 2 * s.windNoise.noise(x, y, z)
+		speed *= 1 + s.windNoise.noise(x+31.7, y+17.3, z+5.1)
+	default:
+		return [2]float64{}
+	}
+	return [2]float64{math.Cos(heading) * speed, math.Sin(heading) * speed}
+}
+
+// windEnergyRatio scales the cost of flying at velocity through wind: a
+// headwind makes it dearer, a tailwind cheaper.
+func windEnergyRatio(velocity, wind [2]float64) float64 {
+	heading := normalize(velocity)
+	headwind := -(heading[0]*wind[0] + heading[1]*wind[1])
+	return math.Max(minWindEnergyRatio, 1+headwindEnergyCost*headwind)
+}
+
+// WindField is the wind sampled at the centres of a Resolution by Resolution
+// grid over the world, row by row from the origin, for display.
+type WindField struct {
+	Time       int          `json:"time"`
+	Resolution int          `json:"resolution"`
+	CellSize   float64      `json:"cellSize"`
+	Vectors    [][2]float64 `json:"vectors"`
+}
+
+// Wind samples the current wind on a grid of the given resolution, clamped
+// to [1, 100].
+func (s *Simulation) Wind(resolution int) WindField {
+	resolution = clampInt(resolution, 1, maxWindResolution)
+	field := WindField{
+		Time:       s.state.Time,
+		Resolution: resolution,
+		CellSize:   float64(s.config.WorldSize) / float64(resolution),
+		Vectors:    make([][2]float64, 0, resolution*resolution),
+	}
+	for row := 0; row < resolution; row++ {
+		for col := 0; col < resolution; col++ {
+			centre := [2]float64{(float64(col) + 0.5) * field.CellSize, (float64(row) + 0.5) * field.CellSize}
+			field.Vectors = append(field.Vectors, s.windAt(centre))
+		}
+	}
+	return field
+}
+
+// perlin is Ken Perlin's improved gradient noise in three dimensions, with a
+// permutation drawn from the run seed. The salt tells apart the noises of
+// different uses.
+type perlin struct {
+	perm [512]uint8
+}
+
+func newPerlin(seed int64, salt uint64) *perlin {
+	p := &perlin{}
+	rng := newAgentRand(seed, 0, 0, salt)
+	for i := 0; i < 256; i++ {
+		p.perm[i] = uint8(i)
+	}
+	for i := 255; i > 0; i-- {
+		j := int(rng.Uint64() % uint64(i+1))
+		p.perm[i], p.perm[j] = p.perm[j], p.perm[i]
+	}
+	copy(p.perm[256:], p.perm[:256])
+	return p
+}
+
+// noise returns the noise at (x, y, z), roughly within [-1, 1].
+func (p *perlin) noise(x, y, z float64) float64 {
+	fx, fy, fz := math.Floor(x), math.Floor(y), math.Floor(z)
+	cx, cy, cz := int(fx)&255, int(fy)&255, int(fz)&255
+	x, y, z = x-fx, y-fy, z-fz
+	u, v, w := fade(x), fade(y), fade(z)
+
+	perm := &p.perm
+	a := int(perm[cx]) + cy
+	aa, ab := int(perm[a])+cz, int(perm[a+1])+cz
+	b := int(perm[cx+1]) + cy
+	ba, bb := int(perm[b])+cz, int(perm[b+1])+cz
+
+	return lerp(w,
+		lerp(v,
+			lerp(u, grad(perm[aa], x, y, z), grad(perm[ba], x-1, y, z)),
+			lerp(u, grad(perm[ab], x, y-1, z), grad(perm[bb], x-1, y-1, z))),
+		lerp(v,
+			lerp(u, grad(perm[aa+1], x, y, z-1), grad(perm[ba+1], x-1, y, z-1)),
+			lerp(u, grad(perm[ab+1], x, y-1, z-1), grad(perm[bb+1], x-1, y-1, z-1))))
+}
+
+func fade(t float64) float64 { return t * t * t * (t*(t*6-15) + 10) }
+
+func lerp(t, a, b float64) float64 { return a + t*(b-a) }
+
+// grad returns the dot product of (x, y, z) with one of twelve gradient
+// directions picked by hash.
+func grad(hash uint8, x, y, z float64) float64 {
+	h := hash & 15
+	u := y
+	if h < 8 {
+		u = x
+	}
+	v := z
+	if h < 4 {
+		v = y
+	} else if h == 12 || h == 14 {
+		v = x
+	}
+	if h&1 != 0 {
+		u = -u
+	}
+	if h&2 != 0 {
+		v = -v
+	}
+	return u + v
+}
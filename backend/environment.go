@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"gitlab.utc.fr/cmbouopd/migration.git/engine"
+)
+
+// environmentGrid holds the layers read from ENVIRONMENT_FILE, if any.
+var environmentGrid *engine.EnvironmentGrid
+
+// loadEnvironmentGrid reads the environmental layers of the simulations from
+// a JSON file. An empty path means the layers are interpolated from the
+// zones.
+func loadEnvironmentGrid(path string) (*engine.EnvironmentGrid, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var grid engine.EnvironmentGrid
+	if err := json.Unmarshal(data, &grid); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := validateEnvironmentGrid(&grid); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &grid, nil
+}
+
+// validateEnvironmentGrid checks that every layer of grid has a value per
+// cell. A nil grid is valid.
+func validateEnvironmentGrid(grid *engine.EnvironmentGrid) error {
+	if grid == nil {
+		return nil
+	}
+	if grid.Cols <= 0 || grid.Rows <= 0 {
+		return fmt.Errorf("cols and rows must be positive")
+	}
+	cells := grid.Cols * grid.Rows
+	layers := []struct {
+		name   string
+		values []float64
+	}{
+		{"temperature", grid.Temperature},
+		{"seasonalAmplitude", grid.SeasonalAmplitude},
+		{"foodAvailability", grid.FoodAvailability},
+		{"predatorPresence", grid.PredatorPresence},
+	}
+	for _, layer := range layers {
+		if len(layer.values) != 0 && len(layer.values) != cells {
+			return fmt.Errorf("%s has %d values, want %d", layer.name, len(layer.values), cells)
+		}
+	}
+	return nil
+}
+
+// resolveConfig completes a configuration with the species of the catalog
+// and checks its fields, environment grid, terrain and obstacles. The error
+// lists every invalid field.
+func resolveConfig(config *engine.SimulationConfig) error {
+	var errs fieldErrors
+	if err := catalog.resolve(config); err != nil {
+		errs.add("species", "%v", err)
+	}
+	errs = append(errs, validateConfig(config)...)
+	if err := validateEnvironmentGrid(config.EnvironmentGrid); err != nil {
+		errs.add("environmentGrid", "%v", err)
+	}
+	if err := validateHeightmap(config.Terrain); err != nil {
+		errs.add("terrain", "%v", err)
+	}
+	if err := validateObstacles(config.Obstacles); err != nil {
+		errs.add("obstacles", "%v", err)
+	}
+	return errs.err()
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"gitlab.utc.fr/cmbouopd/migration.git/engine"
+)
+
+const sessionKey = "session"
+
+// Pagination of GET /saves
+const (
+	defaultSavesLimit = 20
+	maxSavesLimit     = 100
+)
+
+// defaultWindResolution is the number of wind samples per side of the world
+// returned by GET /environment/wind.
+const defaultWindResolution = 20
+
+// useSession resolves the :id path parameter to a session.
+func useSession(c *gin.Context) {
+	s, ok := sessions.get(c.Param("id"))
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "simulation not found"})
+		return
+	}
+	c.Set(sessionKey, s)
+}
+
+// useDefaultSession binds the legacy endpoints to the default session.
+func useDefaultSession(c *gin.Context) {
+	s, ok := sessions.get(defaultSessionID)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "simulation not found"})
+		return
+	}
+	c.Set(sessionKey, s)
+}
+
+func currentSession(c *gin.Context) *session {
+	return c.MustGet(sessionKey).(*session)
+}
+
+// abortOnSessionError reports a failed request to a session loop.
+func abortOnSessionError(c *gin.Context, err error) bool {
+	if err == nil {
+		return false
+	}
+	status := http.StatusInternalServerError
+	if err == errSessionClosed {
+		status = http.StatusGone
+	}
+	c.JSON(status, gin.H{"error": err.Error()})
+	return true
+}
+
+// abortOnInvalid reports an invalid request body, listing its invalid
+// fields if any.
+func abortOnInvalid(c *gin.Context, err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == errSessionClosed {
+		return abortOnSessionError(c, err)
+	}
+	var fields fieldErrors
+	if errors.As(err, &fields) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid fields", "fields": fields})
+	} else {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+	return true
+}
+
+// registerSessionRoutes mounts every per-simulation operation. simulation
+// receives the /simulation endpoints, environment the /environment and
+// zone endpoints; both may be the same group.
+func registerSessionRoutes(simulation, environment *gin.RouterGroup) {
+	simulation.POST("/start", func(c *gin.Context) {
+		if abortOnSessionError(c, currentSession(c).StartSimulation()) {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Simulation started"})
+	})
+
+	simulation.POST("/stop", func(c *gin.Context) {
+		if abortOnSessionError(c, currentSession(c).StopSimulation()) {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Simulation stopped"})
+	})
+
+	simulation.GET("", func(c *gin.Context) {
+		state, err := currentSession(c).GetSimulationState()
+		if abortOnSessionError(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, state)
+	})
+
+	// Trait distributions of the living birds, per generation
+	simulation.GET("/traits", func(c *gin.Context) {
+		state, err := currentSession(c).GetSimulationState()
+		if abortOnSessionError(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, engine.TraitDistributions(state.Birds))
+	})
+
+	simulation.GET("/stream", streamSSE)
+	simulation.GET("/ws", streamWebSocket)
+
+	simulation.GET("/config", func(c *gin.Context) {
+		config, err := currentSession(c).GetSimulationConfig()
+		if abortOnSessionError(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, config)
+	})
+
+	simulation.POST("/config", func(c *gin.Context) {
+		var newConfig engine.SimulationConfig
+		if err := c.ShouldBindJSON(&newConfig); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if abortOnInvalid(c, resolveConfig(&newConfig)) {
+			return
+		}
+		if _, err := currentSession(c).SetSimulationConfig(newConfig); abortOnSessionError(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Simulation config updated"})
+	})
+
+	// Changes only the fields present in the body, as a JSON merge patch.
+	// The world is kept unless a field that shapes it changed.
+	simulation.PATCH("/config", func(c *gin.Context) {
+		patch, err := c.GetRawData()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		result, err := currentSession(c).UpdateSimulationConfig(func(config *engine.SimulationConfig) error {
+			if err := applyPatch(config, patch); err != nil {
+				return err
+			}
+			return resolveConfig(config)
+		})
+		if abortOnInvalid(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+
+	simulation.POST("/time-step", func(c *gin.Context) {
+		var newTimeStep struct {
+			TimeStep int `json:"timeStep"`
+		}
+		if err := c.ShouldBindJSON(&newTimeStep); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if abortOnSessionError(c, currentSession(c).SetTimeStep(newTimeStep.TimeStep)) {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Time step updated"})
+	})
+
+	simulation.GET("/time-step", func(c *gin.Context) {
+		step, err := currentSession(c).GetTimeStep()
+		if abortOnSessionError(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"timeStep": step})
+	})
+
+	// Advances a stopped simulation by n ticks, one by default
+	simulation.POST("/step", func(c *gin.Context) {
+		n := 1
+		if value := c.Query("n"); value != "" {
+			var err error
+			n, err = strconv.Atoi(value)
+			if err != nil || n < 1 || n > maxSteps {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("n must be an integer between 1 and %d", maxSteps)})
+				return
+			}
+		}
+		result, err := currentSession(c).Step(n)
+		if err == errRunning {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if abortOnSessionError(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+
+	simulation.GET("/speed", func(c *gin.Context) {
+		speed, err := currentSession(c).GetSpeed()
+		if abortOnSessionError(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, speed)
+	})
+
+	// Changes the milliseconds between ticks, zero for as fast as possible,
+	// without regenerating the world
+	simulation.POST("/speed", func(c *gin.Context) {
+		var newSpeed struct {
+			SimulationSpeed *int `json:"simulationSpeed"`
+		}
+		if err := c.ShouldBindJSON(&newSpeed); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if newSpeed.SimulationSpeed == nil || *newSpeed.SimulationSpeed < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "simulationSpeed must be zero or a positive number of milliseconds"})
+			return
+		}
+		speed, err := currentSession(c).SetSpeed(*newSpeed.SimulationSpeed)
+		if abortOnSessionError(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, speed)
+	})
+
+	simulation.POST("/save", func(c *gin.Context) {
+		err := SaveSimulationState(currentSession(c))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Simulation state saved"})
+	})
+
+	// Restores the latest save of the simulation; a POST since it replaces
+	// the running state
+	simulation.POST("/load", func(c *gin.Context) {
+		savedState, err := LoadSimulationState(currentSession(c))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, savedState)
+	})
+
+	environment.POST("/environment", func(c *gin.Context) {
+		var factors engine.EnvironmentalFactors
+		if err := c.ShouldBindJSON(&factors); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if abortOnInvalid(c, validateEnvironment(&factors)) {
+			return
+		}
+		if _, err := currentSession(c).SetEnvironmentalFactors(factors); abortOnSessionError(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Environmental factors updated"})
+	})
+
+	// Changes only the factors present in the body, as a JSON merge patch,
+	// keeping the world.
+	environment.PATCH("/environment", func(c *gin.Context) {
+		patch, err := c.GetRawData()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		result, err := currentSession(c).UpdateEnvironmentalFactors(func(env *engine.EnvironmentalFactors) error {
+			if err := applyPatch(env, patch); err != nil {
+				return err
+			}
+			return validateEnvironment(env)
+		})
+		if abortOnInvalid(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+
+	environment.GET("/environment", func(c *gin.Context) {
+		factors, err := currentSession(c).GetEnvironmentalFactors()
+		if abortOnSessionError(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, factors)
+	})
+
+	// Wind sampled on a grid, ?resolution=N cells per side
+	environment.GET("/environment/wind", func(c *gin.Context) {
+		resolution, err := strconv.Atoi(c.DefaultQuery("resolution", strconv.Itoa(defaultWindResolution)))
+		if err != nil || resolution < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "resolution must be a positive integer"})
+			return
+		}
+		wind, err := currentSession(c).GetWind(resolution)
+		if abortOnSessionError(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, wind)
+	})
+
+	environment.GET("/temperature-zones", func(c *gin.Context) {
+		state, err := currentSession(c).GetSimulationState()
+		if abortOnSessionError(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, state.TemperatureZones)
+	})
+
+	environment.POST("/temperature-zones", func(c *gin.Context) {
+		var zones []engine.TemperatureZone
+		if err := c.ShouldBindJSON(&zones); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if abortOnInvalid(c, validateTemperatureZones(zones)) {
+			return
+		}
+		if abortOnSessionError(c, currentSession(c).SetTemperatureZones(zones)) {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Temperature zones updated"})
+	})
+
+	environment.GET("/zones", func(c *gin.Context) {
+		state, err := currentSession(c).GetSimulationState()
+		if abortOnSessionError(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, state.Zones)
+	})
+
+	environment.POST("/zones", func(c *gin.Context) {
+		var zones []engine.Zone
+		if err := c.ShouldBindJSON(&zones); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if abortOnInvalid(c, validateZones(zones)) {
+			return
+		}
+		if abortOnSessionError(c, currentSession(c).SetZones(zones)) {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Zones updated"})
+	})
+}
+
+// sessionSummary is the listing entry returned by GET /simulations.
+type sessionSummary struct {
+	ID          string                      `json:"id"`
+	Config      engine.SimulationConfig     `json:"config"`
+	Environment engine.EnvironmentalFactors `json:"environment"`
+	IsRunning   bool                        `json:"isRunning"`
+	Time        int                         `json:"time"`
+	BirdCount   int                         `json:"birdCount"`
+}
+
+func summarizeSession(s *session) (sessionSummary, error) {
+	snapshot, err := s.Snapshot()
+	if err != nil {
+		return sessionSummary{}, err
+	}
+	return sessionSummary{
+		ID:          s.ID,
+		Config:      snapshot.Config,
+		Environment: snapshot.Environment,
+		IsRunning:   snapshot.State.IsRunning,
+		Time:        snapshot.State.Time,
+		BirdCount:   len(snapshot.State.Birds),
+	}, nil
+}
+
+// registerSessionManagementRoutes mounts the /simulations collection.
+func registerSessionManagementRoutes(router *gin.Engine) {
+	router.POST("/simulations", func(c *gin.Context) {
+		// Fields left out of the body keep the values from the .env file
+		request := struct {
+			Config      engine.SimulationConfig     `json:"config"`
+			Environment engine.EnvironmentalFactors `json:"environment"`
+		}{
+			Config:      defaultSimulationConfig(),
+			Environment: defaultEnvironmentalFactors(),
+		}
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&request); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		if abortOnInvalid(c, resolveConfig(&request.Config)) || abortOnInvalid(c, validateEnvironment(&request.Environment)) {
+			return
+		}
+		s := sessions.create("", request.Config, request.Environment)
+		summary, err := summarizeSession(s)
+		if abortOnSessionError(c, err) {
+			return
+		}
+		c.JSON(http.StatusCreated, summary)
+	})
+
+	router.GET("/simulations", func(c *gin.Context) {
+		summaries := []sessionSummary{}
+		for _, s := range sessions.list() {
+			summary, err := summarizeSession(s)
+			if err != nil {
+				// Deleted while listing
+				continue
+			}
+			summaries = append(summaries, summary)
+		}
+		c.JSON(http.StatusOK, summaries)
+	})
+
+	router.DELETE("/simulations/:id", func(c *gin.Context) {
+		id := c.Param("id")
+		if id == defaultSessionID {
+			c.JSON(http.StatusConflict, gin.H{"error": "the default simulation cannot be deleted"})
+			return
+		}
+		if !sessions.remove(id) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "simulation not found"})
+			return
+		}
+		forgetCheckpoints(id)
+		c.JSON(http.StatusOK, gin.H{"message": "Simulation deleted"})
+	})
+
+	group := router.Group("/simulations/:id", useSession)
+	registerSessionRoutes(group, group)
+}
+
+// sessionOrDefault resolves the session a save request applies to: the one named
+// by id, or the default session.
+func sessionOrDefault(c *gin.Context, id string) (*session, bool) {
+	if id == "" {
+		id = defaultSessionID
+	}
+	s, ok := sessions.get(id)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "simulation not found"})
+	}
+	return s, ok
+}
+
+// saveID parses the :id path parameter of the /saves routes.
+func saveID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "save id must be a positive integer"})
+		return 0, false
+	}
+	return id, true
+}
+
+// abortOnSaveError reports a failed request on saved states.
+func abortOnSaveError(c *gin.Context, err error) bool {
+	if err == errSaveNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return true
+	}
+	return abortOnSessionError(c, err)
+}
+
+// registerSaveRoutes mounts the /saves collection. Saves are shared by every
+// simulation; they are taken from and restored into the default one unless
+// another is named.
+func registerSaveRoutes(router *gin.Engine) {
+	router.GET("/saves", func(c *gin.Context) {
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultSavesLimit)))
+		if err != nil || limit < 1 || limit > maxSavesLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be an integer between 1 and %d", maxSavesLimit)})
+			return
+		}
+		offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+		if err != nil || offset < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "offset must be a non-negative integer"})
+			return
+		}
+		saves, total, err := listSaves(limit, offset)
+		if abortOnSaveError(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"saves": saves, "total": total, "limit": limit, "offset": offset})
+	})
+
+	// Saves the current state of a simulation, the default one unless the
+	// body names another
+	router.POST("/saves", func(c *gin.Context) {
+		var request struct {
+			Name        string   `json:"name"`
+			Description string   `json:"description"`
+			Tags        []string `json:"tags"`
+			Simulation  string   `json:"simulation"`
+		}
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&request); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		s, ok := sessionOrDefault(c, request.Simulation)
+		if !ok {
+			return
+		}
+		info, err := saveSession(s, saveInfo{Name: request.Name, Description: request.Description, Tags: request.Tags})
+		if abortOnSaveError(c, err) {
+			return
+		}
+		c.JSON(http.StatusCreated, info)
+	})
+
+	// Reads a saved state without restoring it
+	router.GET("/saves/:id", func(c *gin.Context) {
+		id, ok := saveID(c)
+		if !ok {
+			return
+		}
+		saved, err := getSave(id)
+		if abortOnSaveError(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, saved)
+	})
+
+	router.DELETE("/saves/:id", func(c *gin.Context) {
+		id, ok := saveID(c)
+		if !ok {
+			return
+		}
+		if abortOnSaveError(c, deleteSave(id)) {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Saved state deleted"})
+	})
+
+	// Replaces the world of a simulation, the default one unless
+	// ?simulation= names another, with a saved state. The simulation is left
+	// stopped.
+	router.POST("/saves/:id/restore", func(c *gin.Context) {
+		id, ok := saveID(c)
+		if !ok {
+			return
+		}
+		s, ok := sessionOrDefault(c, c.Query("simulation"))
+		if !ok {
+			return
+		}
+		saved, err := restoreSave(s, id)
+		if abortOnSaveError(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Saved state restored", "save": saved.saveInfo})
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"gitlab.utc.fr/cmbouopd/migration.git/engine"
+)
+
+// obstacles holds the obstacles read from OBSTACLES_FILE, if any.
+var obstacles []engine.Obstacle
+
+// loadObstacles reads the obstacles placed in the simulations from a JSON
+// file. An empty path means only mountains are generated.
+func loadObstacles(path string) ([]engine.Obstacle, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var loaded []engine.Obstacle
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := validateObstacles(loaded); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return loaded, nil
+}
+
+// validateObstacles checks that every obstacle has a known shape and enough
+// points, or a radius for a mountain.
+func validateObstacles(obstacles []engine.Obstacle) error {
+	for i, obstacle := range obstacles {
+		if obstacle.Height < 0 {
+			return fmt.Errorf("obstacle %d: height must not be negative", i)
+		}
+		switch obstacle.Shape {
+		case "", "circle":
+			if obstacle.Radius <= 0 {
+				return fmt.Errorf("obstacle %d: radius must be positive", i)
+			}
+		case "polygon":
+			if len(obstacle.Points) < 3 {
+				return fmt.Errorf("obstacle %d: a polygon needs at least 3 points", i)
+			}
+		case "polyline":
+			if len(obstacle.Points) < 2 {
+				return fmt.Errorf("obstacle %d: a polyline needs at least 2 points", i)
+			}
+		default:
+			return fmt.Errorf("obstacle %d: unknown shape %q", i, obstacle.Shape)
+		}
+	}
+	return nil
+}
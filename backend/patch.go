@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// applyPatch applies a JSON merge patch (RFC 7386) to v: the fields present
+// in the patch replace those of v, objects are merged field by field, arrays
+// are replaced whole and null resets a field to its zero value, which means
+// its default. Unknown fields and values of the wrong type are reported as
+// fieldErrors.
+func applyPatch[T any](v *T, patch []byte) error {
+	var changes any
+	if err := decodeNumbers(patch, &changes); err != nil {
+		return err
+	}
+	if _, ok := changes.(map[string]any); !ok {
+		return errors.New("patch must be a JSON object")
+	}
+
+	current, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var target any
+	if err := decodeNumbers(current, &target); err != nil {
+		return err
+	}
+	merged, err := json.Marshal(mergePatch(target, changes))
+	if err != nil {
+		return err
+	}
+
+	// Decode into a new value so that the slices of v are not reused
+	var patched T
+	decoder := json.NewDecoder(bytes.NewReader(merged))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patched); err != nil {
+		return patchError(err, changes)
+	}
+	*v = patched
+	return nil
+}
+
+// decodeNumbers decodes JSON keeping numbers as they are written, so that
+// large integers such as seeds survive a round trip.
+func decodeNumbers(data []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+func mergePatch(target, patch any) any {
+	changes, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	merged, ok := target.(map[string]any)
+	if !ok {
+		merged = make(map[string]any)
+	}
+	for key, value := range changes {
+		if value == nil {
+			delete(merged, key)
+		} else {
+			merged[key] = mergePatch(merged[key], value)
+		}
+	}
+	return merged
+}
+
+// patchError reports the field a merged patch could not be decoded into.
+// The decoder names an unknown field without its parents; it can only come
+// from changes, where its path is looked up.
+func patchError(err error, changes any) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return fieldErrors{{Field: typeErr.Field, Message: fmt.Sprintf("must be %s, not %s", typeErr.Type, typeErr.Value)}}
+	}
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		field = strings.Trim(field, `"`)
+		if path, ok := fieldPath(changes, field); ok {
+			field = path
+		}
+		return fieldErrors{{Field: field, Message: "unknown field"}}
+	}
+	return err
+}
+
+// fieldPath returns the dotted path of the first field called name in v, in
+// key order. Arrays do not appear in the path, as in the type errors of the
+// decoder.
+func fieldPath(v any, name string) (string, bool) {
+	switch v := v.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if key == name {
+				return key, true
+			}
+			if path, ok := fieldPath(v[key], name); ok {
+				return key + "." + path, true
+			}
+		}
+	case []any:
+		for _, item := range v {
+			if path, ok := fieldPath(item, name); ok {
+				return path, true
+			}
+		}
+	}
+	return "", false
+}
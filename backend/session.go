@@ -0,0 +1,730 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"gitlab.utc.fr/cmbouopd/migration.git/engine"
+)
+
+// defaultSessionID identifies the session served by the legacy
+// /simulation, /environment and /zones endpoints.
+const defaultSessionID = "default"
+
+// maxSteps is the largest number of ticks a single step request may advance.
+const maxSteps = 10000
+
+var (
+	errSessionClosed = errors.New("simulation session has been deleted")
+	errRunning       = errors.New("simulation is running; stop it before stepping")
+)
+
+// fastTicks is always ready to receive from: a loop ticking on it steps as
+// fast as it can while still serving its other channels.
+var fastTicks = func() chan time.Time {
+	ticks := make(chan time.Time)
+	close(ticks)
+	return ticks
+}()
+
+// --- Sessions ---
+
+// session is one simulation world driven by its own loop goroutine. Every
+// access to sim from the HTTP handlers goes through the session channels.
+type session struct {
+	ID  string
+	sim *engine.Simulation
+
+	// Channels for synchronisation
+	stateChan             chan simulationRequest
+	configChan            chan configRequest
+	environmentChan       chan environmentRequest
+	timeStepChan          chan timeStepRequest
+	simulationControlChan chan simulationControlRequest
+	subscribeChan         chan *subscriber
+	unsubscribeChan       chan *subscriber
+	keyframeChan          chan *subscriber
+	windChan              chan windRequest
+	stepChan              chan stepRequest
+	speedChan             chan speedRequest
+	zonesChan             chan zonesRequest
+	temperatureZonesChan  chan temperatureZonesRequest
+	snapshotChan          chan snapshotRequest
+	restoreChan           chan restoreRequest
+
+	// Stream clients, the tick sequence number, the ticker and the measured
+	// tick rate, owned by the loop goroutine
+	subscribers map[*subscriber]struct{}
+	seq         int
+	ticker      *time.Ticker
+	rate        tickRate
+
+	// Autosave, nil when off, and the ticks since the last checkpoint
+	checkpoints     *checkpointer
+	sinceCheckpoint int
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type simulationRequest struct {
+	responseChan chan engine.SimulationState
+}
+
+// configRequest reads the configuration, after changing it with update
+// unless update is nil.
+type configRequest struct {
+	update       func(*engine.SimulationConfig) error
+	responseChan chan configUpdate
+}
+
+// configUpdate is the configuration of a session after a config request, and
+// whether the request regenerated the world.
+type configUpdate struct {
+	Config engine.SimulationConfig `json:"config"`
+	Reset  bool                    `json:"reset"`
+	err    error
+}
+
+// environmentRequest reads the environmental factors, after changing them
+// with update unless update is nil.
+type environmentRequest struct {
+	update       func(*engine.EnvironmentalFactors) error
+	responseChan chan environmentUpdate
+}
+
+type environmentUpdate struct {
+	Environment engine.EnvironmentalFactors `json:"environment"`
+	err         error
+}
+
+type timeStepRequest struct {
+	set          bool
+	newTimeStep  int
+	responseChan chan int
+}
+
+type windRequest struct {
+	resolution   int
+	responseChan chan engine.WindField
+}
+
+type stepRequest struct {
+	n            int
+	responseChan chan stepResult
+}
+
+type stepResult struct {
+	Time           int     `json:"time"`
+	Steps          int     `json:"steps"`
+	TicksPerSecond float64 `json:"ticksPerSecond"`
+	err            error
+}
+
+type speedRequest struct {
+	set          bool
+	speed        int
+	responseChan chan speedInfo
+}
+
+// speedInfo is the cadence of a session: the speed it is set to and the
+// rate it actually achieves while running.
+type speedInfo struct {
+	SimulationSpeed int     `json:"simulationSpeed"`
+	TicksPerSecond  float64 `json:"ticksPerSecond"`
+}
+
+type zonesRequest struct {
+	zones        []engine.Zone
+	responseChan chan struct{}
+}
+
+type temperatureZonesRequest struct {
+	zones        []engine.TemperatureZone
+	responseChan chan struct{}
+}
+
+// snapshotRequest reads the state of a session together with what it takes
+// to resume it, all from the same tick.
+type snapshotRequest struct {
+	responseChan chan sessionSnapshot
+}
+
+type sessionSnapshot struct {
+	State       engine.SimulationState
+	Config      engine.SimulationConfig
+	Environment engine.EnvironmentalFactors
+	TimeStep    int
+}
+
+// restoreRequest replaces the world of a session with a saved one.
+type restoreRequest struct {
+	state        engine.SimulationState
+	config       engine.SimulationConfig
+	environment  *engine.EnvironmentalFactors
+	timeStep     int
+	responseChan chan struct{}
+}
+
+type simulationControlRequest struct {
+	action       string
+	responseChan chan bool
+}
+
+func newSession(id string, simConfig engine.SimulationConfig, env engine.EnvironmentalFactors) *session {
+	s := &session{
+		ID:                    id,
+		sim:                   engine.New(simConfig, env),
+		stateChan:             make(chan simulationRequest),
+		configChan:            make(chan configRequest),
+		environmentChan:       make(chan environmentRequest),
+		timeStepChan:          make(chan timeStepRequest),
+		simulationControlChan: make(chan simulationControlRequest),
+		subscribeChan:         make(chan *subscriber),
+		unsubscribeChan:       make(chan *subscriber),
+		keyframeChan:          make(chan *subscriber),
+		windChan:              make(chan windRequest),
+		stepChan:              make(chan stepRequest),
+		speedChan:             make(chan speedRequest),
+		zonesChan:             make(chan zonesRequest),
+		temperatureZonesChan:  make(chan temperatureZonesRequest),
+		snapshotChan:          make(chan snapshotRequest),
+		restoreChan:           make(chan restoreRequest),
+		subscribers:           make(map[*subscriber]struct{}),
+		checkpoints:           checkpoints,
+		done:                  make(chan struct{}),
+	}
+	go s.startSimulationLoop()
+	return s
+}
+
+// close stops the session loop and its ticker. Requests sent afterwards
+// fail with errSessionClosed.
+func (s *session) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+func (s *session) startSimulationLoop() {
+	s.resetTicker()
+	defer func() {
+		if s.ticker != nil {
+			s.ticker.Stop()
+		}
+	}()
+	var autosave <-chan time.Time
+	if s.checkpoints != nil && s.checkpoints.policy.Interval > 0 {
+		autosaveTicker := time.NewTicker(s.checkpoints.policy.Interval)
+		defer autosaveTicker.Stop()
+		autosave = autosaveTicker.C
+	}
+
+	for {
+		select {
+		case <-s.done:
+			for sub := range s.subscribers {
+				s.dropSubscriber(sub)
+			}
+			return
+		case <-s.ticks():
+			s.step()
+		case <-autosave:
+			if s.sinceCheckpoint > 0 {
+				s.checkpoint()
+			}
+		case sub := <-s.subscribeChan:
+			s.addSubscriber(sub)
+		case sub := <-s.unsubscribeChan:
+			s.dropSubscriber(sub)
+		case sub := <-s.keyframeChan:
+			s.requestKeyframe(sub)
+		case req := <-s.stateChan:
+			req.responseChan <- s.sim.Snapshot()
+		case req := <-s.configChan:
+			req.responseChan <- s.updateConfig(req.update)
+		case req := <-s.environmentChan:
+			req.responseChan <- s.updateEnvironment(req.update)
+		case req := <-s.windChan:
+			req.responseChan <- s.sim.Wind(req.resolution)
+		case req := <-s.timeStepChan:
+			if req.set {
+				s.sim.SetTimeStep(req.newTimeStep)
+			}
+			req.responseChan <- s.sim.TimeStep()
+		case req := <-s.stepChan:
+			req.responseChan <- s.stepBatch(req.n)
+		case req := <-s.speedChan:
+			if req.set {
+				s.sim.SetSpeed(req.speed)
+				s.resetTicker()
+			}
+			req.responseChan <- speedInfo{SimulationSpeed: s.sim.Speed(), TicksPerSecond: s.rate.perSecond}
+		case req := <-s.zonesChan:
+			s.sim.SetZones(req.zones)
+			req.responseChan <- struct{}{}
+		case req := <-s.temperatureZonesChan:
+			s.sim.SetTemperatureZones(req.zones)
+			req.responseChan <- struct{}{}
+		case req := <-s.snapshotChan:
+			req.responseChan <- s.snapshot()
+		case req := <-s.restoreChan:
+			if req.environment != nil {
+				s.sim.UpdateEnvironment(*req.environment)
+			}
+			s.sim.Restore(req.state, req.config)
+			if req.timeStep > 0 {
+				s.sim.SetTimeStep(req.timeStep)
+			}
+			s.rate.restart()
+			s.resetTicker()
+			req.responseChan <- struct{}{}
+		case req := <-s.simulationControlChan:
+			switch req.action {
+			case "start":
+				s.sim.Start()
+				s.rate.restart()
+				req.responseChan <- true
+			case "stop":
+				s.sim.Stop()
+				s.rate.restart()
+				req.responseChan <- true
+			case "restart":
+				s.sim.Reset()
+				s.rate.restart()
+				req.responseChan <- true
+			}
+		}
+	}
+}
+
+// resetTicker makes the loop tick every SimulationSpeed milliseconds, or as
+// fast as it can when the speed is zero.
+func (s *session) resetTicker() {
+	if s.ticker != nil {
+		s.ticker.Stop()
+		s.ticker = nil
+	}
+	if speed := s.sim.Speed(); speed > 0 {
+		s.ticker = time.NewTicker(time.Duration(speed) * time.Millisecond)
+	}
+}
+
+// ticks returns the channel the loop steps on: none while paused, so that a
+// fast loop does not spin.
+func (s *session) ticks() <-chan time.Time {
+	switch {
+	case !s.sim.Running():
+		return nil
+	case s.ticker != nil:
+		return s.ticker.C
+	default:
+		return fastTicks
+	}
+}
+
+// step advances the simulation by one tick, publishes it and checkpoints it
+// when due.
+func (s *session) step() {
+	s.sim.Step()
+	s.seq++
+	s.rate.tick()
+	s.publish()
+	s.sinceCheckpoint++
+	if s.checkpoints != nil && s.checkpoints.policy.Ticks > 0 && s.sinceCheckpoint >= s.checkpoints.policy.Ticks {
+		s.checkpoint()
+	}
+}
+
+func (s *session) snapshot() sessionSnapshot {
+	return sessionSnapshot{
+		State:       s.sim.Snapshot(),
+		Config:      s.sim.Config(),
+		Environment: s.sim.Environment(),
+		TimeStep:    s.sim.TimeStep(),
+	}
+}
+
+// checkpoint hands a snapshot of the session to the checkpoint writer.
+func (s *session) checkpoint() {
+	s.checkpoints.enqueue(s.ID, s.snapshot())
+	s.sinceCheckpoint = 0
+}
+
+// stepBatch advances a paused simulation by exactly n ticks.
+func (s *session) stepBatch(n int) stepResult {
+	if s.sim.Running() {
+		return stepResult{err: errRunning}
+	}
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		s.step()
+	}
+	result := stepResult{Time: s.sim.Snapshot().Time, Steps: n}
+	if elapsed := time.Since(start).Seconds(); elapsed > 0 {
+		result.TicksPerSecond = float64(n) / elapsed
+	}
+	return result
+}
+
+// updateConfig changes the configuration with update. Fields that take
+// effect on the next tick, such as the speed, keep the world; any other
+// change regenerates it.
+func (s *session) updateConfig(update func(*engine.SimulationConfig) error) configUpdate {
+	config := s.sim.Config()
+	if update == nil {
+		return configUpdate{Config: config}
+	}
+	if err := update(&config); err != nil {
+		return configUpdate{err: err}
+	}
+	reset := s.sim.UpdateConfig(config)
+	if reset {
+		s.rate.restart()
+	}
+	s.resetTicker()
+	return configUpdate{Config: s.sim.Config(), Reset: reset}
+}
+
+// updateEnvironment changes the environmental factors with update, keeping
+// the world.
+func (s *session) updateEnvironment(update func(*engine.EnvironmentalFactors) error) environmentUpdate {
+	env := s.sim.Environment()
+	if update == nil {
+		return environmentUpdate{Environment: env}
+	}
+	if err := update(&env); err != nil {
+		return environmentUpdate{err: err}
+	}
+	s.sim.UpdateEnvironment(env)
+	return environmentUpdate{Environment: s.sim.Environment()}
+}
+
+// tickRate measures the number of ticks a session loop achieves per second,
+// over windows of about a second.
+type tickRate struct {
+	since     time.Time
+	ticks     int
+	perSecond float64
+}
+
+func (r *tickRate) tick() {
+	now := time.Now()
+	if r.since.IsZero() {
+		r.since = now
+	}
+	r.ticks++
+	if elapsed := now.Sub(r.since).Seconds(); elapsed >= 1 {
+		r.perSecond = float64(r.ticks) / elapsed
+		r.since, r.ticks = now, 0
+	}
+}
+
+// restart forgets the measured rate, when the simulation starts or stops.
+func (r *tickRate) restart() {
+	*r = tickRate{}
+}
+
+// send hands req to the session loop, giving up if the session is closed.
+func send[T any](s *session, ch chan T, req T) error {
+	select {
+	case ch <- req:
+		return nil
+	case <-s.done:
+		return errSessionClosed
+	}
+}
+
+func (s *session) StartSimulation() error {
+	responseChan := make(chan bool)
+	if err := send(s, s.simulationControlChan, simulationControlRequest{
+		action:       "start",
+		responseChan: responseChan,
+	}); err != nil {
+		return err
+	}
+	result := <-responseChan
+	log.Println(result)
+	return nil
+}
+
+func (s *session) StopSimulation() error {
+	responseChan := make(chan bool)
+	if err := send(s, s.simulationControlChan, simulationControlRequest{
+		action:       "stop",
+		responseChan: responseChan,
+	}); err != nil {
+		return err
+	}
+	<-responseChan
+	return nil
+}
+
+func (s *session) GetSimulationState() (engine.SimulationState, error) {
+	responseChan := make(chan engine.SimulationState)
+	if err := send(s, s.stateChan, simulationRequest{
+		responseChan: responseChan,
+	}); err != nil {
+		return engine.SimulationState{}, err
+	}
+	state := <-responseChan
+	return state, nil
+}
+
+func (s *session) GetSimulationConfig() (engine.SimulationConfig, error) {
+	result, err := s.UpdateSimulationConfig(nil)
+	return result.Config, err
+}
+
+// GetWind samples the current wind of the session on a grid.
+func (s *session) GetWind(resolution int) (engine.WindField, error) {
+	responseChan := make(chan engine.WindField)
+	if err := send(s, s.windChan, windRequest{
+		resolution:   resolution,
+		responseChan: responseChan,
+	}); err != nil {
+		return engine.WindField{}, err
+	}
+	return <-responseChan, nil
+}
+
+// SetSimulationConfig replaces the configuration of the session.
+func (s *session) SetSimulationConfig(newConfig engine.SimulationConfig) (configUpdate, error) {
+	return s.UpdateSimulationConfig(func(config *engine.SimulationConfig) error {
+		*config = newConfig
+		return nil
+	})
+}
+
+// UpdateSimulationConfig changes the configuration of the session with update,
+// on the session loop. Errors of update are returned as they are.
+func (s *session) UpdateSimulationConfig(update func(*engine.SimulationConfig) error) (configUpdate, error) {
+	responseChan := make(chan configUpdate)
+	if err := send(s, s.configChan, configRequest{
+		update:       update,
+		responseChan: responseChan,
+	}); err != nil {
+		return configUpdate{}, err
+	}
+	result := <-responseChan
+	return result, result.err
+}
+
+// Step advances a paused simulation by n ticks.
+func (s *session) Step(n int) (stepResult, error) {
+	responseChan := make(chan stepResult)
+	if err := send(s, s.stepChan, stepRequest{
+		n:            n,
+		responseChan: responseChan,
+	}); err != nil {
+		return stepResult{}, err
+	}
+	result := <-responseChan
+	return result, result.err
+}
+
+// GetSpeed returns the speed of the session and the tick rate it achieves.
+func (s *session) GetSpeed() (speedInfo, error) {
+	responseChan := make(chan speedInfo)
+	if err := send(s, s.speedChan, speedRequest{
+		responseChan: responseChan,
+	}); err != nil {
+		return speedInfo{}, err
+	}
+	return <-responseChan, nil
+}
+
+// SetSpeed changes the speed of the session without regenerating its world.
+func (s *session) SetSpeed(speed int) (speedInfo, error) {
+	responseChan := make(chan speedInfo)
+	if err := send(s, s.speedChan, speedRequest{
+		set:          true,
+		speed:        speed,
+		responseChan: responseChan,
+	}); err != nil {
+		return speedInfo{}, err
+	}
+	return <-responseChan, nil
+}
+
+func (s *session) SetTimeStep(newTimeStep int) error {
+	responseChan := make(chan int)
+	if err := send(s, s.timeStepChan, timeStepRequest{
+		set:          true,
+		newTimeStep:  newTimeStep,
+		responseChan: responseChan,
+	}); err != nil {
+		return err
+	}
+	<-responseChan
+	return nil
+}
+
+func (s *session) GetTimeStep() (int, error) {
+	responseChan := make(chan int)
+	if err := send(s, s.timeStepChan, timeStepRequest{
+		responseChan: responseChan,
+	}); err != nil {
+		return 0, err
+	}
+	return <-responseChan, nil
+}
+
+// SetZones replaces the zones of the session.
+func (s *session) SetZones(zones []engine.Zone) error {
+	responseChan := make(chan struct{})
+	if err := send(s, s.zonesChan, zonesRequest{
+		zones:        zones,
+		responseChan: responseChan,
+	}); err != nil {
+		return err
+	}
+	<-responseChan
+	return nil
+}
+
+// SetTemperatureZones replaces the temperature zones of the session.
+func (s *session) SetTemperatureZones(zones []engine.TemperatureZone) error {
+	responseChan := make(chan struct{})
+	if err := send(s, s.temperatureZonesChan, temperatureZonesRequest{
+		zones:        zones,
+		responseChan: responseChan,
+	}); err != nil {
+		return err
+	}
+	<-responseChan
+	return nil
+}
+
+// Snapshot returns a copy of the state, configuration, environment and time
+// step of the session, taken between two ticks.
+func (s *session) Snapshot() (sessionSnapshot, error) {
+	responseChan := make(chan sessionSnapshot)
+	if err := send(s, s.snapshotChan, snapshotRequest{
+		responseChan: responseChan,
+	}); err != nil {
+		return sessionSnapshot{}, err
+	}
+	return <-responseChan, nil
+}
+
+// Restore replaces the world of the session with a saved state, left
+// stopped. A nil environment or a zero time step keeps the current one.
+func (s *session) Restore(state engine.SimulationState, config engine.SimulationConfig, env *engine.EnvironmentalFactors, timeStep int) error {
+	responseChan := make(chan struct{})
+	if err := send(s, s.restoreChan, restoreRequest{
+		state:        state,
+		config:       config,
+		environment:  env,
+		timeStep:     timeStep,
+		responseChan: responseChan,
+	}); err != nil {
+		return err
+	}
+	<-responseChan
+	return nil
+}
+
+// SetEnvironmentalFactors replaces the environmental factors of the session.
+func (s *session) SetEnvironmentalFactors(factors engine.EnvironmentalFactors) (environmentUpdate, error) {
+	return s.UpdateEnvironmentalFactors(func(env *engine.EnvironmentalFactors) error {
+		*env = factors
+		return nil
+	})
+}
+
+func (s *session) GetEnvironmentalFactors() (engine.EnvironmentalFactors, error) {
+	result, err := s.UpdateEnvironmentalFactors(nil)
+	return result.Environment, err
+}
+
+// UpdateEnvironmentalFactors changes the environmental factors of the session
+// with update, on the session loop. Errors of update are returned as they are.
+func (s *session) UpdateEnvironmentalFactors(update func(*engine.EnvironmentalFactors) error) (environmentUpdate, error) {
+	responseChan := make(chan environmentUpdate)
+	if err := send(s, s.environmentChan, environmentRequest{
+		update:       update,
+		responseChan: responseChan,
+	}); err != nil {
+		return environmentUpdate{}, err
+	}
+	result := <-responseChan
+	return result, result.err
+}
+
+// --- Session registry ---
+
+type sessionRegistry struct {
+	mu       sync.RWMutex
+	sessions map[string]*session
+	nextID   int
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[string]*session)}
+}
+
+// create starts a new session. An empty id allocates the next numeric one.
+func (r *sessionRegistry) create(id string, simConfig engine.SimulationConfig, env engine.EnvironmentalFactors) *session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id == "" {
+		r.nextID++
+		id = strconv.Itoa(r.nextID)
+	}
+	s := newSession(id, simConfig, env)
+	r.sessions[id] = s
+	return s
+}
+
+// reserve makes create allocate IDs past the numeric ones among ids, so that
+// new sessions do not take over the saves of earlier ones.
+func (r *sessionRegistry) reserve(ids []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, id := range ids {
+		if n, err := strconv.Atoi(id); err == nil && n > r.nextID {
+			r.nextID = n
+		}
+	}
+}
+
+func (r *sessionRegistry) get(id string) (*session, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.sessions[id]
+	return s, ok
+}
+
+// list returns the sessions ordered by ID.
+func (r *sessionRegistry) list() []*session {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	list := make([]*session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if len(list[i].ID) != len(list[j].ID) {
+			return len(list[i].ID) < len(list[j].ID)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// remove closes the session and forgets it.
+func (r *sessionRegistry) remove(id string) bool {
+	r.mu.Lock()
+	s, ok := r.sessions[id]
+	delete(r.sessions, id)
+	r.mu.Unlock()
+	if ok {
+		s.close()
+	}
+	return ok
+}
@@ -0,0 +1,651 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "github.com/mattn/go-sqlite3"
+
+	"gitlab.utc.fr/cmbouopd/migration.git/engine"
+)
+
+// These tests drive sessions from many goroutines at once. Run them with
+// go test -race: any state shared between a session loop and its callers
+// is reported as a data race.
+
+func testConfig() engine.SimulationConfig {
+	return engine.SimulationConfig{
+		WorldSize:     300,
+		InitialBirds:  40,
+		ObstacleCount: 2,
+		ResourceCount: 3,
+		Seed:          1,
+		Workers:       2,
+		Obstacles: []engine.Obstacle{
+			{Shape: "polygon", Points: [][2]float64{{100, 100}, {140, 100}, {120, 140}}, Height: 20},
+		},
+	}
+}
+
+func testEnvironment() engine.EnvironmentalFactors {
+	return engine.EnvironmentalFactors{Temperature: 20, FoodAvailability: 1, PredatorPresence: 0.2}
+}
+
+// newTestServer starts a default session ticking as fast as it can and
+// returns the router serving it.
+func newTestServer(t *testing.T) (*gin.Engine, *session) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	sessions = newSessionRegistry()
+	s := sessions.create(defaultSessionID, testConfig(), testEnvironment())
+	t.Cleanup(func() { sessions.remove(defaultSessionID) })
+
+	router := gin.New()
+	registerSessionRoutes(router.Group("/simulation", useDefaultSession), router.Group("", useDefaultSession))
+	registerSessionManagementRoutes(router)
+	return router, s
+}
+
+func serve(router *gin.Engine, method, path, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	router, _ := newTestServer(t)
+
+	requests := []struct {
+		method, path, body string
+		statuses           []int // Accepted statuses, 200 if empty
+	}{
+		{method: "GET", path: "/simulation"},
+		{method: "GET", path: "/simulation/config"},
+		{method: "GET", path: "/simulation/traits"},
+		{method: "GET", path: "/simulation/speed"},
+		{method: "GET", path: "/simulation/time-step"},
+		{method: "GET", path: "/environment"},
+		{method: "GET", path: "/environment/wind?resolution=4"},
+		{method: "GET", path: "/zones"},
+		{method: "GET", path: "/temperature-zones"},
+		{method: "GET", path: "/simulations"},
+		{method: "PATCH", path: "/simulation/config", body: `{"captureProbability": 0.2, "mutationRate": 0.05}`},
+		{method: "PATCH", path: "/environment", body: `{"temperature": 18, "wind": {"mode": "uniform", "speed": 0.5}}`},
+		{method: "POST", path: "/simulation/time-step", body: `{"timeStep": 1}`},
+		{method: "POST", path: "/simulation/speed", body: `{"simulationSpeed": 0}`},
+		{method: "POST", path: "/zones", body: `[{"id": 0, "position": [75, 75], "temperature": 15, "foodAvailability": 1, "role": "breeding"}, {"id": 1, "position": [225, 225], "temperature": 25, "foodAvailability": 0.8, "role": "wintering"}]`},
+		{method: "POST", path: "/temperature-zones", body: `[{"region": 0, "temperature": 12}]`},
+		{method: "POST", path: "/simulation/stop"},
+		{method: "POST", path: "/simulation/step?n=3", statuses: []int{http.StatusOK, http.StatusConflict}},
+		{method: "POST", path: "/simulation/start"},
+	}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 3*len(requests); i++ {
+				request := requests[(i+worker*5)%len(requests)]
+				recorder := serve(router, request.method, request.path, request.body)
+				accepted := request.statuses
+				if len(accepted) == 0 {
+					accepted = []int{http.StatusOK}
+				}
+				ok := false
+				for _, status := range accepted {
+					ok = ok || recorder.Code == status
+				}
+				if !ok {
+					t.Errorf("%s %s: status %d: %s", request.method, request.path, recorder.Code, recorder.Body)
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+}
+
+// A paused simulation advances by exactly the ticks asked for, and changing
+// its speed keeps its world.
+func TestStepAndSpeed(t *testing.T) {
+	router, s := newTestServer(t)
+	if recorder := serve(router, "POST", "/simulation/step?n=3", ""); recorder.Code != http.StatusConflict {
+		t.Fatalf("stepping a running simulation: status %d", recorder.Code)
+	}
+	if err := s.StopSimulation(); err != nil {
+		t.Fatal(err)
+	}
+	before, err := s.GetSimulationState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []int{1, 7, 25} {
+		recorder := serve(router, "POST", fmt.Sprintf("/simulation/step?n=%d", n), "")
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("POST /simulation/step?n=%d: status %d: %s", n, recorder.Code, recorder.Body)
+		}
+		var result stepResult
+		if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		state, err := s.GetSimulationState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Steps != n || result.Time != before.Time+n || state.Time != before.Time+n || state.IsRunning {
+			t.Fatalf("step n=%d from tick %d: reported %+v, at tick %d, running %v", n, before.Time, result, state.Time, state.IsRunning)
+		}
+		before = state
+	}
+
+	for _, speed := range []int{0, 250, 10} {
+		if _, err := s.SetSpeed(speed); err != nil {
+			t.Fatal(err)
+		}
+		state, err := s.GetSimulationState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.Time != before.Time || !slices.Equal(birdIDs(state), birdIDs(before)) {
+			t.Fatalf("speed %d moved the world from tick %d to %d", speed, before.Time, state.Time)
+		}
+	}
+}
+
+func birdIDs(state engine.SimulationState) []int {
+	ids := make([]int, len(state.Birds))
+	for i, bird := range state.Birds {
+		ids[i] = bird.ID
+	}
+	return ids
+}
+
+func TestSnapshotsAreCopies(t *testing.T) {
+	_, s := newTestServer(t)
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				state, err := s.GetSimulationState()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				// Scribble over every slice of the copy while the loop ticks
+				for j := range state.Birds {
+					state.Birds[j].Position = [2]float64{-1, -1}
+				}
+				for j := range state.Obstacles {
+					for k := range state.Obstacles[j].Points {
+						state.Obstacles[j].Points[k] = [2]float64{}
+					}
+				}
+				for j := range state.Zones {
+					state.Zones[j].Temperature = -100
+				}
+				for j := range state.Predators {
+					state.Predators[j].Energy = -1
+				}
+				for name := range state.Population.Species {
+					delete(state.Population.Species, name)
+				}
+
+				config, err := s.GetSimulationConfig()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for j := range config.Species {
+					for k := range config.Species[j].Diet {
+						config.Species[j].Diet[k] = "scribbled"
+					}
+				}
+				for j := range config.Obstacles {
+					config.Obstacles[j].Points[0] = [2]float64{}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	state, err := s.GetSimulationState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bird := range state.Birds {
+		if bird.Position == [2]float64{-1, -1} {
+			t.Fatalf("bird %d was moved through a snapshot", bird.ID)
+		}
+	}
+	config, err := s.GetSimulationConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, share := range config.Species {
+		for _, food := range share.Diet {
+			if food == "scribbled" {
+				t.Fatalf("species %s was changed through a config copy", share.Name)
+			}
+		}
+	}
+	if config.Obstacles[0].Points[0] != testConfig().Obstacles[0].Points[0] {
+		t.Fatalf("obstacle was changed through a config copy: %v", config.Obstacles[0].Points)
+	}
+}
+
+// openTestDatabase points db at a new database for the test.
+func openTestDatabase(t *testing.T) {
+	t.Helper()
+	var err error
+	db, err = sql.Open("sqlite3", filepath.Join(t.TempDir(), "simulation.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := initDatabase(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSaveAndLoadWhileRunning(t *testing.T) {
+	_, s := newTestServer(t)
+	openTestDatabase(t)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := s.GetSimulationState(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		if err := SaveSimulationState(s); err != nil {
+			t.Fatal(err)
+		}
+		saved, err := LoadSimulationState(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state, err := s.GetSimulationState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.IsRunning || state.Time != saved.State.Time || len(state.Birds) != len(saved.State.Birds) {
+			t.Fatalf("restored tick %d with %d birds, running %v; saved tick %d with %d birds",
+				state.Time, len(state.Birds), state.IsRunning, saved.State.Time, len(saved.State.Birds))
+		}
+		if err := s.StartSimulation(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// Only a POST restores the latest save: a GET must not change the world.
+func TestLoadIsAPost(t *testing.T) {
+	router, s := newTestServer(t)
+	openTestDatabase(t)
+	if err := SaveSimulationState(s); err != nil {
+		t.Fatal(err)
+	}
+	if recorder := serve(router, "GET", "/simulation/load", ""); recorder.Code == http.StatusOK {
+		t.Fatalf("GET /simulation/load: status %d", recorder.Code)
+	}
+	if state, err := s.GetSimulationState(); err != nil || !state.IsRunning {
+		t.Fatalf("GET /simulation/load stopped the simulation: %v", err)
+	}
+	if recorder := serve(router, "POST", "/simulation/load", ""); recorder.Code != http.StatusOK {
+		t.Fatalf("POST /simulation/load: status %d: %s", recorder.Code, recorder.Body)
+	}
+	if state, err := s.GetSimulationState(); err != nil || state.IsRunning {
+		t.Fatalf("POST /simulation/load left the simulation running: %v", err)
+	}
+}
+
+func TestLoadSkipsCheckpointsAndOtherSessions(t *testing.T) {
+	_, s := newTestServer(t)
+	openTestDatabase(t)
+	if err := SaveSimulationState(s); err != nil {
+		t.Fatal(err)
+	}
+	want, _, err := listSaves(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := insertSave(snapshot, saveInfo{Name: "autosave", Simulation: s.ID, Checkpoint: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := insertSave(snapshot, saveInfo{Simulation: "2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := LoadSimulationState(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.ID != want[0].ID {
+		t.Fatalf("loaded save %d, want %d", saved.ID, want[0].ID)
+	}
+}
+
+func TestCheckpointsWhileRunning(t *testing.T) {
+	openTestDatabase(t)
+	checkpoints = newCheckpointer(autosavePolicy{Ticks: 5, Interval: 10 * time.Millisecond, Keep: 2})
+	t.Cleanup(func() { checkpoints = nil })
+	router, s := newTestServer(t)
+	if _, err := s.SetSpeed(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep the loop busy while it checkpoints
+	for i := 0; i < 20; i++ {
+		serve(router, "PATCH", "/environment", `{"temperature": 15}`)
+		serve(router, "POST", "/zones", `[{"id": 0, "position": [50, 50], "temperature": 15, "foodAvailability": 1}]`)
+		time.Sleep(5 * time.Millisecond)
+	}
+	state, err := s.GetSimulationState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoints.close(sessions.list())
+
+	saves, total, err := listSaves(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 {
+		t.Fatalf("%d checkpoints kept, want 2", total)
+	}
+	if !saves[0].Checkpoint || saves[0].Tick < state.Time {
+		t.Fatalf("last checkpoint at tick %d, want the state at shutdown, past tick %d", saves[0].Tick, state.Time)
+	}
+
+	s.StopSimulation()
+	if ok, err := resume(s); !ok || err != nil {
+		t.Fatalf("resume: %v, %v", ok, err)
+	}
+	resumed, err := s.GetSimulationState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resumed.IsRunning || resumed.Time < saves[0].Tick {
+		t.Fatalf("resumed at tick %d, running %v; checkpoint at tick %d", resumed.Time, resumed.IsRunning, saves[0].Tick)
+	}
+}
+
+func TestDeleteSessionForgetsCheckpoints(t *testing.T) {
+	openTestDatabase(t)
+	checkpoints = newCheckpointer(autosavePolicy{Ticks: 1000, Keep: 2})
+	t.Cleanup(func() { checkpoints = nil })
+	router, _ := newTestServer(t)
+	s := sessions.create("", testConfig(), testEnvironment())
+	snapshot, err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoints.enqueue(s.ID, snapshot)
+	if w := serve(router, "DELETE", "/simulations/"+s.ID, ""); w.Code != http.StatusOK {
+		t.Fatalf("DELETE /simulations/%s: %d %s", s.ID, w.Code, w.Body)
+	}
+	// One last checkpoint from the loop of the deleted session
+	checkpoints.enqueue(s.ID, snapshot)
+	checkpoints.close(sessions.list())
+
+	ids, err := savedSessions(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != defaultSessionID {
+		t.Fatalf("sessions with checkpoints: %v, want only %s", ids, defaultSessionID)
+	}
+}
+
+// Removing a session must not wait for the writer, which session loops
+// would then wait for too.
+func TestForgetWithBusyWriter(t *testing.T) {
+	// No writer runs: the queue stays full
+	c := &checkpointer{
+		queue:     make(chan checkpoint, 1),
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		forgotten: make(map[string]bool),
+	}
+	c.queue <- checkpoint{sessionID: "1"}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.forget("1")
+		c.forget("2")
+		c.enqueue("3", sessionSnapshot{})
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("forget waited for the writer")
+	}
+	if len(c.forgets) != 2 {
+		t.Fatalf("%d forgets pending, want 2", len(c.forgets))
+	}
+}
+
+func TestResumeEverySession(t *testing.T) {
+	openTestDatabase(t)
+	_, s := newTestServer(t)
+	snapshot, err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := insertSave(snapshot, saveInfo{Name: "autosave", Simulation: "3", Checkpoint: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := savedSessions(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions.reserve(saved)
+	if err := resumeSessions(testConfig(), testEnvironment()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sessions.remove("3") })
+	resumed, ok := sessions.get("3")
+	if !ok {
+		t.Fatal("simulation 3 was not resumed")
+	}
+	state, err := resumed.GetSimulationState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.IsRunning || state.Time < snapshot.State.Time {
+		t.Fatalf("simulation 3 resumed at tick %d, running %v; checkpoint at tick %d", state.Time, state.IsRunning, snapshot.State.Time)
+	}
+
+	created := sessions.create("", testConfig(), testEnvironment())
+	t.Cleanup(func() { sessions.remove(created.ID) })
+	if created.ID != "4" {
+		t.Fatalf("new simulation %s, want 4 past the saved ones", created.ID)
+	}
+}
+
+func TestStreamWhileMutating(t *testing.T) {
+	router, s := newTestServer(t)
+	// Pace the loop so that the client keeps up and is not dropped
+	if _, err := s.SetSpeed(5); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "GET", server.URL+"/simulation/stream?mode=delta&fields=birds,obstacles", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			patch := `{"worldSize": 320}`
+			if i%2 == 1 {
+				patch = `{"worldSize": 300}`
+			}
+			if recorder := serve(router, "PATCH", "/simulation/config", patch); recorder.Code != http.StatusOK {
+				t.Errorf("PATCH /simulation/config: status %d: %s", recorder.Code, recorder.Body)
+			}
+			serve(router, "POST", "/zones", `[{"id": 0, "position": [50, 50], "temperature": 15, "foodAvailability": 1}]`)
+		}
+	}()
+
+	frames := 0
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(nil, 1<<22)
+	for frames < 20 && scanner.Scan() {
+		data, ok := bytes.CutPrefix(scanner.Bytes(), []byte("data:"))
+		if !ok {
+			continue
+		}
+		data = bytes.TrimSpace(data)
+		if !json.Valid(data) {
+			t.Fatalf("invalid frame %q", data)
+		}
+		frames++
+	}
+	<-done
+	if frames < 20 {
+		t.Fatalf("received %d frames: %v", frames, scanner.Err())
+	}
+}
+
+func TestClosedSession(t *testing.T) {
+	_, s := newTestServer(t)
+	sessions.remove(defaultSessionID)
+
+	if _, err := s.GetSimulationState(); err != errSessionClosed {
+		t.Fatalf("GetSimulationState on a deleted session: %v", err)
+	}
+	if err := s.SetZones(nil); err != errSessionClosed {
+		t.Fatalf("SetZones on a deleted session: %v", err)
+	}
+	if _, err := s.Step(1); err != errSessionClosed {
+		t.Fatalf("Step on a deleted session: %v", err)
+	}
+}
+
+// receiveState reads the next frame of a delta subscriber and applies it to
+// state, or replaces state with it if it is a keyframe.
+func receiveState(t *testing.T, sub *subscriber, state *engine.SimulationState) {
+	t.Helper()
+	var frame struct {
+		Type  string          `json:"type"`
+		State json.RawMessage `json:"state"`
+		Delta engine.Delta    `json:"delta"`
+	}
+	select {
+	case data := <-sub.frames:
+		if err := json.Unmarshal(data, &frame); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no frame received")
+	}
+	if frame.Type == "keyframe" {
+		*state = engine.SimulationState{}
+		if err := json.Unmarshal(frame.State, state); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	frame.Delta.Apply(state)
+}
+
+func TestDeltasAcrossMutations(t *testing.T) {
+	_, s := newTestServer(t)
+	if err := s.StopSimulation(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both clients join at the same seq, with the zones changed in between
+	first := &subscriber{every: 1, delta: true, frames: make(chan []byte, subscriberBuffer)}
+	var firstState engine.SimulationState
+	if err := s.Subscribe(first); err != nil {
+		t.Fatal(err)
+	}
+	receiveState(t, first, &firstState)
+	if err := s.SetZones([]engine.Zone{{ID: 0, Position: [2]float64{50, 50}, Temperature: 15, FoodAvailability: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	second := &subscriber{every: 1, delta: true, frames: make(chan []byte, subscriberBuffer)}
+	var secondState engine.SimulationState
+	if err := s.Subscribe(second); err != nil {
+		t.Fatal(err)
+	}
+	receiveState(t, second, &secondState)
+
+	if _, err := s.Step(1); err != nil {
+		t.Fatal(err)
+	}
+	receiveState(t, first, &firstState)
+	receiveState(t, second, &secondState)
+
+	state, err := s.GetSimulationState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, got := range map[string]engine.SimulationState{"first": firstState, "second": secondState} {
+		data, err := json.Marshal(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, want) {
+			t.Errorf("%s client rebuilt a state different from the next one", name)
+		}
+	}
+}
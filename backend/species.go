@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"gitlab.utc.fr/cmbouopd/migration.git/engine"
+)
+
+// speciesCatalog holds the species simulations can be configured with, by
+// name. It always contains engine.DefaultSpecies.
+type speciesCatalog struct {
+	mu      sync.RWMutex
+	species map[string]engine.Species
+}
+
+var catalog *speciesCatalog
+
+// loadSpeciesCatalog reads a JSON array of species from path. A missing file
+// leaves the catalog with the default species only.
+func loadSpeciesCatalog(path string) (*speciesCatalog, error) {
+	c := &speciesCatalog{species: map[string]engine.Species{engine.DefaultSpecies.Name: engine.DefaultSpecies}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var species []engine.Species
+	if err := json.Unmarshal(data, &species); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, sp := range species {
+		if sp.Name == "" {
+			return nil, fmt.Errorf("%s: species without a name", path)
+		}
+		if err := validateSpecies("", &sp).err(); err != nil {
+			return nil, fmt.Errorf("%s: species %s: %w", path, sp.Name, err)
+		}
+		c.species[sp.Name] = sp
+	}
+	return c, nil
+}
+
+func (c *speciesCatalog) list() []engine.Species {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	species := make([]engine.Species, 0, len(c.species))
+	for _, sp := range c.species {
+		species = append(species, sp)
+	}
+	sort.Slice(species, func(i, j int) bool { return species[i].Name < species[j].Name })
+	return species
+}
+
+func (c *speciesCatalog) get(name string) (engine.Species, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	sp, ok := c.species[name]
+	return sp, ok
+}
+
+// put adds or replaces a species and reports whether it is new.
+func (c *speciesCatalog) put(sp engine.Species) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, exists := c.species[sp.Name]
+	c.species[sp.Name] = sp
+	return !exists
+}
+
+func (c *speciesCatalog) remove(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.species[name]
+	delete(c.species, name)
+	return ok
+}
+
+// resolve replaces the entries of the species mix of config that only give a
+// name with the species of that name in the catalog. Entries with parameters
+// define their species inline.
+func (c *speciesCatalog) resolve(config *engine.SimulationConfig) error {
+	for i, share := range config.Species {
+		if !nameOnly(share.Species) {
+			continue
+		}
+		sp, ok := c.get(share.Name)
+		if !ok {
+			return fmt.Errorf("unknown species %q", share.Name)
+		}
+		config.Species[i].Species = sp
+	}
+	return nil
+}
+
+func nameOnly(sp engine.Species) bool {
+	if sp.Name == "" || len(sp.Diet) > 0 {
+		return false
+	}
+	sp.Name, sp.Diet = "", nil
+	return reflect.DeepEqual(sp, engine.Species{})
+}
+
+// parseSpeciesMix parses the SPECIES_MIX setting, a comma separated list of
+// name:share pairs such as "swallow:2,goose:1". A name without a share
+// counts for 1.
+func parseSpeciesMix(value string) ([]engine.SpeciesShare, error) {
+	var mix []engine.SpeciesShare
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, shareText, found := strings.Cut(entry, ":")
+		share := 1.0
+		if found {
+			var err error
+			share, err = strconv.ParseFloat(shareText, 64)
+			if err != nil || share < 0 {
+				return nil, fmt.Errorf("invalid share for species %q", name)
+			}
+		}
+		mix = append(mix, engine.SpeciesShare{Species: engine.Species{Name: name}, Share: share})
+	}
+	return mix, nil
+}
+
+// registerSpeciesRoutes mounts the /species catalog.
+func registerSpeciesRoutes(router *gin.Engine) {
+	router.GET("/species", func(c *gin.Context) {
+		c.JSON(http.StatusOK, catalog.list())
+	})
+
+	router.GET("/species/:name", func(c *gin.Context) {
+		sp, ok := catalog.get(c.Param("name"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "species not found"})
+			return
+		}
+		c.JSON(http.StatusOK, sp)
+	})
+
+	router.POST("/species", func(c *gin.Context) {
+		var sp engine.Species
+		if err := c.ShouldBindJSON(&sp); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		errs := validateSpecies("", &sp)
+		if sp.Name == "" {
+			errs.add("name", "is required")
+		}
+		if abortOnInvalid(c, errs.err()) {
+			return
+		}
+		status := http.StatusOK
+		if catalog.put(sp) {
+			status = http.StatusCreated
+		}
+		c.JSON(status, sp)
+	})
+
+	router.DELETE("/species/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		if name == engine.DefaultSpecies.Name {
+			c.JSON(http.StatusConflict, gin.H{"error": "the default species cannot be deleted"})
+			return
+		}
+		if !catalog.remove(name) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "species not found"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Species deleted"})
+	})
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"gitlab.utc.fr/cmbouopd/migration.git/engine"
+)
+
+var db *sql.DB
+
+var errSaveNotFound = errors.New("saved state not found")
+
+// saveInfo describes a saved state without the state itself.
+type saveInfo struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Tags        []string  `json:"tags"`
+	Simulation  string    `json:"simulation"` // ID of the session it was saved from
+	Checkpoint  bool      `json:"checkpoint"` // Saved automatically, see checkpoint.go
+	Tick        int       `json:"tick"`
+	BirdCount   int       `json:"birdCount"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+type SaveState struct {
+	saveInfo
+	State       engine.SimulationState       `json:"state"`
+	Config      engine.SimulationConfig      `json:"config"`
+	Environment *engine.EnvironmentalFactors `json:"environment,omitempty"` // Nil for states saved before it was kept
+	TimeStep    int                          `json:"timeStep"`
+	Seed        int64                        `json:"seed"`
+}
+
+func initDatabase() error {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS saved_states (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            state TEXT,
+			config TEXT,
+			time_step INTEGER,
+			seed INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+        )
+    `)
+	if err != nil {
+		return fmt.Errorf("error creating saved_states table: %w", err)
+	}
+
+	// Databases created before a column existed are upgraded in place
+	columns := []struct{ name, definition string }{
+		{"seed", "INTEGER NOT NULL DEFAULT 0"},
+		{"name", "TEXT NOT NULL DEFAULT ''"},
+		{"description", "TEXT NOT NULL DEFAULT ''"},
+		{"tags", "TEXT NOT NULL DEFAULT '[]'"},
+		{"session_id", "TEXT NOT NULL DEFAULT ''"},
+		{"tick", "INTEGER"},
+		{"bird_count", "INTEGER"},
+		{"environment", "TEXT"},
+		{"checkpoint", "INTEGER NOT NULL DEFAULT 0"},
+	}
+	for _, column := range columns {
+		if err := addColumnIfMissing("saved_states", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+	// States saved before their tick and bird count were kept get them from
+	// the state itself
+	_, err = db.Exec(`
+		UPDATE saved_states
+		SET tick = COALESCE(json_extract(state, '$.time'), 0),
+			bird_count = COALESCE(json_array_length(state, '$.birds'), 0)
+		WHERE tick IS NULL AND json_valid(state)
+	`)
+	if err != nil {
+		return fmt.Errorf("error filling in saved state ticks: %w", err)
+	}
+	// States saved before there were several sessions belong to the default one
+	_, err = db.Exec("UPDATE saved_states SET session_id = ? WHERE session_id = ''", defaultSessionID)
+	if err != nil {
+		return fmt.Errorf("error filling in saved state sessions: %w", err)
+	}
+	return nil
+}
+
+func addColumnIfMissing(table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("error reading %s columns: %w", table, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			columnType string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return fmt.Errorf("error reading %s columns: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading %s columns: %w", table, err)
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("error adding %s.%s column: %w", table, column, err)
+	}
+	return nil
+}
+
+// SaveSimulationState saves the current state of a session, without a name.
+func SaveSimulationState(s *session) error {
+	_, err := saveSession(s, saveInfo{})
+	return err
+}
+
+// saveSession saves the current state of a session with the name,
+// description and tags of info, and returns the metadata of the save.
+func saveSession(s *session, info saveInfo) (saveInfo, error) {
+	snapshot, err := s.Snapshot()
+	if err != nil {
+		return saveInfo{}, err
+	}
+	info.Simulation = s.ID
+	return insertSave(snapshot, info)
+}
+
+// insertSave saves a snapshot of the session info.Simulation.
+func insertSave(snapshot sessionSnapshot, info saveInfo) (saveInfo, error) {
+	state := snapshot.State
+
+	stateJSON, err := json.Marshal(state)
+	if err != nil {
+		return saveInfo{}, fmt.Errorf("error marshaling simulation state: %w", err)
+	}
+
+	configJSON, err := json.Marshal(snapshot.Config)
+	if err != nil {
+		return saveInfo{}, fmt.Errorf("error marshaling simulation config: %w", err)
+	}
+
+	environmentJSON, err := json.Marshal(snapshot.Environment)
+	if err != nil {
+		return saveInfo{}, fmt.Errorf("error marshaling environmental factors: %w", err)
+	}
+
+	if info.Tags == nil {
+		info.Tags = []string{}
+	}
+	tagsJSON, err := json.Marshal(info.Tags)
+	if err != nil {
+		return saveInfo{}, fmt.Errorf("error marshaling tags: %w", err)
+	}
+
+	info.Tick = state.Time
+	info.BirdCount = len(state.Birds)
+	result, err := db.Exec(`
+		INSERT INTO saved_states (state, config, environment, time_step, seed, name, description, tags, session_id, tick, bird_count, checkpoint)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		stateJSON, configJSON, environmentJSON, snapshot.TimeStep, state.Seed,
+		info.Name, info.Description, tagsJSON, info.Simulation, info.Tick, info.BirdCount, info.Checkpoint)
+	if err != nil {
+		return saveInfo{}, fmt.Errorf("error saving simulation state to DB: %w", err)
+	}
+	info.ID, err = result.LastInsertId()
+	if err != nil {
+		return saveInfo{}, fmt.Errorf("error saving simulation state to DB: %w", err)
+	}
+	row := db.QueryRow("SELECT created_at FROM saved_states WHERE id = ?", info.ID)
+	if err := row.Scan(&info.CreatedAt); err != nil {
+		return saveInfo{}, fmt.Errorf("error saving simulation state to DB: %w", err)
+	}
+	return info, nil
+}
+
+const saveInfoColumns = "id, name, description, tags, session_id, checkpoint, COALESCE(tick, 0), COALESCE(bird_count, 0), created_at"
+
+// scanSaveInfo reads the saveInfoColumns of a row, followed by dest.
+func scanSaveInfo(row interface{ Scan(...any) error }, dest ...any) (saveInfo, error) {
+	var info saveInfo
+	var tagsJSON string
+	columns := append([]any{&info.ID, &info.Name, &info.Description, &tagsJSON, &info.Simulation, &info.Checkpoint, &info.Tick, &info.BirdCount, &info.CreatedAt}, dest...)
+	if err := row.Scan(columns...); err != nil {
+		return saveInfo{}, err
+	}
+	if err := json.Unmarshal([]byte(tagsJSON), &info.Tags); err != nil || info.Tags == nil {
+		info.Tags = []string{}
+	}
+	return info, nil
+}
+
+// listSaves returns the metadata of saved states, most recent first, and
+// the total number of saved states.
+func listSaves(limit, offset int) ([]saveInfo, int, error) {
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM saved_states").Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("error counting saved states: %w", err)
+	}
+
+	rows, err := db.Query("SELECT "+saveInfoColumns+" FROM saved_states ORDER BY id DESC LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error listing saved states: %w", err)
+	}
+	defer rows.Close()
+	saves := []saveInfo{}
+	for rows.Next() {
+		info, err := scanSaveInfo(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error listing saved states: %w", err)
+		}
+		saves = append(saves, info)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error listing saved states: %w", err)
+	}
+	return saves, total, nil
+}
+
+// getSave reads a saved state. It changes no session.
+func getSave(id int64) (*SaveState, error) {
+	var stateJSON, configJSON string
+	var environmentJSON sql.NullString
+	var saved SaveState
+
+	row := db.QueryRow("SELECT "+saveInfoColumns+", state, config, environment, time_step, seed FROM saved_states WHERE id = ?", id)
+	info, err := scanSaveInfo(row, &stateJSON, &configJSON, &environmentJSON, &saved.TimeStep, &saved.Seed)
+	if err == sql.ErrNoRows {
+		return nil, errSaveNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading simulation state from DB: %w", err)
+	}
+	saved.saveInfo = info
+
+	if err := json.Unmarshal([]byte(stateJSON), &saved.State); err != nil {
+		return nil, fmt.Errorf("error unmarshaling simulation state: %w", err)
+	}
+	if err := json.Unmarshal([]byte(configJSON), &saved.Config); err != nil {
+		return nil, fmt.Errorf("error unmarshaling simulation config: %w", err)
+	}
+	if environmentJSON.Valid {
+		saved.Environment = &engine.EnvironmentalFactors{}
+		if err := json.Unmarshal([]byte(environmentJSON.String), saved.Environment); err != nil {
+			return nil, fmt.Errorf("error unmarshaling environmental factors: %w", err)
+		}
+	}
+	return &saved, nil
+}
+
+// deleteSave removes a saved state.
+func deleteSave(id int64) error {
+	result, err := db.Exec("DELETE FROM saved_states WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("error deleting saved state: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errSaveNotFound
+	}
+	return nil
+}
+
+// pruneCheckpoints deletes all but the keep most recent checkpoints of a
+// session.
+func pruneCheckpoints(sessionID string, keep int) error {
+	_, err := db.Exec(`
+		DELETE FROM saved_states
+		WHERE checkpoint AND session_id = ? AND id NOT IN (
+			SELECT id FROM saved_states WHERE checkpoint AND session_id = ? ORDER BY id DESC LIMIT ?
+		)`, sessionID, sessionID, keep)
+	if err != nil {
+		return fmt.Errorf("error deleting old checkpoints: %w", err)
+	}
+	return nil
+}
+
+// latestCheckpoint returns the ID of the most recent checkpoint of a
+// session, errSaveNotFound if there is none.
+func latestCheckpoint(sessionID string) (int64, error) {
+	var id int64
+	err := db.QueryRow("SELECT id FROM saved_states WHERE checkpoint AND session_id = ? ORDER BY id DESC LIMIT 1", sessionID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, errSaveNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error reading checkpoints: %w", err)
+	}
+	return id, nil
+}
+
+// deleteCheckpoints removes all the checkpoints of a session.
+func deleteCheckpoints(sessionID string) error {
+	if _, err := db.Exec("DELETE FROM saved_states WHERE checkpoint AND session_id = ?", sessionID); err != nil {
+		return fmt.Errorf("error deleting checkpoints: %w", err)
+	}
+	return nil
+}
+
+// savedSessions returns the IDs of the sessions states were saved from, only
+// those with checkpoints if checkpointed is true.
+func savedSessions(checkpointed bool) ([]string, error) {
+	rows, err := db.Query("SELECT DISTINCT session_id FROM saved_states WHERE checkpoint OR NOT ? ORDER BY session_id", checkpointed)
+	if err != nil {
+		return nil, fmt.Errorf("error reading saved sessions: %w", err)
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("error reading saved sessions: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// restoreSave replaces the world of a session with a saved state, left
+// stopped.
+func restoreSave(s *session, id int64) (*SaveState, error) {
+	saved, err := getSave(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Restore(saved.State, saved.Config, saved.Environment, saved.TimeStep); err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+// LoadSimulationState restores the most recent state saved from a session,
+// leaving out its checkpoints, into it.
+func LoadSimulationState(s *session) (*SaveState, error) {
+	var id int64
+	err := db.QueryRow("SELECT id FROM saved_states WHERE NOT checkpoint AND session_id = ? ORDER BY id DESC LIMIT 1", s.ID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("no saved state found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading simulation state from DB: %w", err)
+	}
+	return restoreSave(s, id)
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+
+	"gitlab.utc.fr/cmbouopd/migration.git/engine"
+)
+
+// subscriberBuffer is the number of frames a stream client may lag behind
+// before it is dropped.
+const subscriberBuffer = 16
+
+// defaultKeyframeInterval is the number of delta frames sent between two
+// keyframes when the client does not choose one.
+const defaultKeyframeInterval = 100
+
+// streamFields lists the state collections a client can select with the
+// fields query parameter. Scalar fields (time, worldSize, ...) are always sent.
+var streamFields = []string{"birds", "predators", "obstacles", "resources", "zones", "temperatureZones"}
+
+// subscriber is a stream client registered with a session loop. Only the loop
+// goroutine touches ticks and sends on frames; the loop closes frames when the
+// client is dropped, unsubscribed or the session is deleted.
+type subscriber struct {
+	every  int
+	fields string // Canonical, comma separated; empty means every field
+	ticks  int
+	frames chan []byte
+
+	// Delta mode: a keyframe with the full state, then diffs against the
+	// previous frame sent to this client
+	delta            bool
+	keyframeInterval int // Deltas between keyframes, 0 for none
+	base             *engine.SimulationState
+	baseSeq          int
+	sinceKeyframe    int
+	needsKeyframe    bool
+}
+
+// keyframeMessage and deltaMessage are the frames of the delta protocol. Seq
+// is the session tick sequence number; a client whose last seq differs from
+// BaseSeq has missed a frame and should ask for a keyframe.
+type keyframeMessage struct {
+	Type  string          `json:"type"`
+	Seq   int             `json:"seq"`
+	State json.RawMessage `json:"state"`
+}
+
+type deltaMessage struct {
+	Type    string       `json:"type"`
+	Seq     int          `json:"seq"`
+	BaseSeq int          `json:"baseSeq"`
+	Delta   engine.Delta `json:"delta"`
+}
+
+func newSubscriber(c *gin.Context) (*subscriber, error) {
+	every := 1
+	if value := c.Query("every"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("every must be a positive integer")
+		}
+		every = n
+	}
+
+	var fields []string
+	if value := c.Query("fields"); value != "" {
+		requested := make(map[string]bool)
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if !isStreamField(field) {
+				return nil, fmt.Errorf("unknown field %q", field)
+			}
+			requested[field] = true
+		}
+		for _, field := range streamFields {
+			if requested[field] {
+				fields = append(fields, field)
+			}
+		}
+	}
+
+	sub := &subscriber{
+		every:            every,
+		fields:           strings.Join(fields, ","),
+		frames:           make(chan []byte, subscriberBuffer),
+		keyframeInterval: defaultKeyframeInterval,
+	}
+
+	switch c.DefaultQuery("mode", "full") {
+	case "full":
+	case "delta":
+		sub.delta = true
+	default:
+		return nil, fmt.Errorf("mode must be full or delta")
+	}
+	if value := c.Query("keyframe"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("keyframe must be a non-negative integer")
+		}
+		sub.keyframeInterval = n
+	}
+	return sub, nil
+}
+
+func isStreamField(field string) bool {
+	for _, f := range streamFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeFrame marshals state keeping only the collections listed in fields.
+func encodeFrame(state engine.SimulationState, fields string) ([]byte, error) {
+	frame, err := json.Marshal(state)
+	if err != nil || fields == "" {
+		return frame, err
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(frame, &values); err != nil {
+		return nil, err
+	}
+	selected := strings.Split(fields, ",")
+	for _, field := range streamFields {
+		if !contains(selected, field) {
+			delete(values, field)
+		}
+	}
+	return json.Marshal(values)
+}
+
+func encodeKeyframe(seq int, state engine.SimulationState, fields string) ([]byte, error) {
+	frame, err := encodeFrame(state, fields)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(keyframeMessage{Type: "keyframe", Seq: seq, State: frame})
+}
+
+func encodeDelta(baseSeq, seq int, base, state engine.SimulationState, fields string) ([]byte, error) {
+	delta := engine.Diff(base, state)
+	if fields != "" {
+		selected := strings.Split(fields, ",")
+		if !contains(selected, "birds") {
+			delta.MovedBirds, delta.Birds, delta.RemovedBirds = nil, nil, nil
+		}
+		if !contains(selected, "predators") {
+			delta.Predators, delta.RemovedPredators = nil, nil
+		}
+		if !contains(selected, "resources") {
+			delta.ResourceLevels, delta.Resources, delta.RemovedResources = nil, nil, nil
+		}
+		if !contains(selected, "obstacles") {
+			delta.Obstacles = nil
+		}
+		if !contains(selected, "zones") {
+			delta.Zones = nil
+		}
+		if !contains(selected, "temperatureZones") {
+			delta.TemperatureZones = nil
+		}
+	}
+	return json.Marshal(deltaMessage{Type: "delta", Seq: seq, BaseSeq: baseSeq, Delta: delta})
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// --- Session side ---
+
+// addSubscriber registers sub and queues the current state as its first frame.
+func (s *session) addSubscriber(sub *subscriber) {
+	s.subscribers[sub] = struct{}{}
+	state := s.sim.Snapshot()
+	frame, err := s.nextFrame(sub, &state, make(map[string][]byte))
+	if err != nil {
+		s.dropSubscriber(sub)
+		return
+	}
+	sub.frames <- frame
+}
+
+func (s *session) dropSubscriber(sub *subscriber) {
+	if _, ok := s.subscribers[sub]; ok {
+		delete(s.subscribers, sub)
+		close(sub.frames)
+	}
+}
+
+// requestKeyframe makes the next frame sent to sub a keyframe.
+func (s *session) requestKeyframe(sub *subscriber) {
+	if _, ok := s.subscribers[sub]; ok {
+		sub.needsKeyframe = true
+	}
+}
+
+// publish pushes the current state to every subscriber due on this tick.
+// Frames are encoded once per distinct kind, base and field selection. A
+// subscriber whose buffer is full is dropped so that a slow client never
+// stalls the loop.
+func (s *session) publish() {
+	if len(s.subscribers) == 0 {
+		return
+	}
+
+	var state *engine.SimulationState
+	frames := make(map[string][]byte)
+	for sub := range s.subscribers {
+		sub.ticks++
+		if sub.ticks%sub.every != 0 {
+			continue
+		}
+		if state == nil {
+			snapshot := s.sim.Snapshot()
+			state = &snapshot
+		}
+		frame, err := s.nextFrame(sub, state, frames)
+		if err != nil {
+			s.dropSubscriber(sub)
+			continue
+		}
+		select {
+		case sub.frames <- frame:
+		default:
+			s.dropSubscriber(sub)
+		}
+	}
+}
+
+// nextFrame encodes the frame due to sub for state, reusing frames already
+// encoded on this tick.
+func (s *session) nextFrame(sub *subscriber, state *engine.SimulationState, frames map[string][]byte) ([]byte, error) {
+	if !sub.delta {
+		return cachedFrame(frames, "full|"+sub.fields, func() ([]byte, error) {
+			return encodeFrame(*state, sub.fields)
+		})
+	}
+
+	keyframe := sub.base == nil || sub.needsKeyframe ||
+		(sub.keyframeInterval > 0 && sub.sinceKeyframe >= sub.keyframeInterval)
+	var frame []byte
+	var err error
+	if keyframe {
+		frame, err = cachedFrame(frames, "keyframe|"+sub.fields, func() ([]byte, error) {
+			return encodeKeyframe(s.seq, *state, sub.fields)
+		})
+		sub.sinceKeyframe = 0
+		sub.needsKeyframe = false
+	} else {
+		base := sub.base
+		// Key on the base itself rather than its seq: the world can change
+		// between two subscriptions without a tick
+		frame, err = cachedFrame(frames, fmt.Sprintf("delta|%p|%s", base, sub.fields), func() ([]byte, error) {
+			return encodeDelta(sub.baseSeq, s.seq, *base, *state, sub.fields)
+		})
+		sub.sinceKeyframe++
+	}
+	sub.base = state
+	sub.baseSeq = s.seq
+	return frame, err
+}
+
+func cachedFrame(frames map[string][]byte, key string, encode func() ([]byte, error)) ([]byte, error) {
+	if frame, ok := frames[key]; ok {
+		return frame, nil
+	}
+	frame, err := encode()
+	if err == nil {
+		frames[key] = frame
+	}
+	return frame, err
+}
+
+func (s *session) Subscribe(sub *subscriber) error {
+	return send(s, s.subscribeChan, sub)
+}
+
+func (s *session) Unsubscribe(sub *subscriber) {
+	_ = send(s, s.unsubscribeChan, sub)
+}
+
+func (s *session) RequestKeyframe(sub *subscriber) {
+	_ = send(s, s.keyframeChan, sub)
+}
+
+// --- Handlers ---
+
+// streamSSE serves state frames as Server-Sent Events. SSE clients of the
+// delta protocol get a fresh keyframe by reconnecting.
+func streamSSE(c *gin.Context) {
+	s := currentSession(c)
+	sub, err := newSubscriber(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if abortOnSessionError(c, s.Subscribe(sub)) {
+		return
+	}
+	defer s.Unsubscribe(sub)
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case frame, ok := <-sub.frames:
+			if !ok {
+				return false
+			}
+			event := "state"
+			if sub.delta {
+				event = "frame"
+			}
+			c.SSEvent(event, string(frame))
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// streamWebSocket serves state frames as WebSocket text messages.
+func streamWebSocket(c *gin.Context) {
+	s := currentSession(c)
+	sub, err := newSubscriber(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Origins are not checked, matching the CORS policy of the REST API
+	server := websocket.Server{Handler: func(ws *websocket.Conn) {
+		defer ws.Close()
+		if err := s.Subscribe(sub); err != nil {
+			return
+		}
+		defer s.Unsubscribe(sub)
+
+		// The only message understood from the client is "keyframe", sent
+		// by delta clients that detected a gap. Reading also detects the
+		// client leaving.
+		gone := make(chan struct{})
+		go func() {
+			defer close(gone)
+			var message string
+			for websocket.Message.Receive(ws, &message) == nil {
+				if strings.TrimSpace(message) == "keyframe" {
+					s.RequestKeyframe(sub)
+				}
+			}
+		}()
+
+		for {
+			select {
+			case frame, ok := <-sub.frames:
+				if !ok {
+					return
+				}
+				if err := websocket.Message.Send(ws, string(frame)); err != nil {
+					return
+				}
+			case <-gone:
+				return
+			}
+		}
+	}}
+	server.ServeHTTP(c.Writer, c.Request)
+}
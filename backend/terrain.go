@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.utc.fr/cmbouopd/migration.git/engine"
+)
+
+// terrainHeightmap holds the heightmap read from TERRAIN_FILE, if any.
+var terrainHeightmap *engine.Heightmap
+
+// loadHeightmap reads a heightmap from a PGM or PNG image, the brightest
+// grey level standing for maxHeight. The first row of the image lies along
+// the origin of the world. An empty path means the terrain is generated.
+func loadHeightmap(path string, maxHeight float64) (*engine.Heightmap, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var heightmap *engine.Heightmap
+	if strings.EqualFold(filepath.Ext(path), ".pgm") {
+		heightmap, err = decodePGM(data, maxHeight)
+	} else {
+		heightmap, err = decodeImage(data, maxHeight)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return heightmap, nil
+}
+
+// decodeImage reads a heightmap from any image format registered with the
+// image package, from the luminance of its pixels.
+func decodeImage(data []byte, maxHeight float64) (*engine.Heightmap, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	heightmap := &engine.Heightmap{Cols: bounds.Dx(), Rows: bounds.Dy()}
+	heightmap.Heights = make([]float64, 0, heightmap.Cols*heightmap.Rows)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			luminance := (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 0xffff
+			heightmap.Heights = append(heightmap.Heights, luminance*maxHeight)
+		}
+	}
+	return heightmap, nil
+}
+
+// decodePGM reads a heightmap from a plain (P2) or raw (P5) PGM image.
+func decodePGM(data []byte, maxHeight float64) (*engine.Heightmap, error) {
+	reader := bufio.NewReader(bytes.NewReader(data))
+	var header [4]int
+	magic, err := pgmToken(reader)
+	if err != nil {
+		return nil, err
+	}
+	if magic != "P2" && magic != "P5" {
+		return nil, fmt.Errorf("not a PGM image")
+	}
+	for i := 1; i < len(header); i++ {
+		token, err := pgmToken(reader)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := fmt.Sscan(token, &header[i]); err != nil || header[i] <= 0 {
+			return nil, fmt.Errorf("invalid PGM header")
+		}
+	}
+	cols, rows, maxGrey := header[1], header[2], header[3]
+	if maxGrey > 0xffff {
+		return nil, fmt.Errorf("invalid PGM header")
+	}
+
+	heightmap := &engine.Heightmap{Cols: cols, Rows: rows, Heights: make([]float64, cols*rows)}
+	for i := range heightmap.Heights {
+		var grey int
+		if magic == "P2" {
+			token, err := pgmToken(reader)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := fmt.Sscan(token, &grey); err != nil {
+				return nil, fmt.Errorf("invalid PGM pixel %q", token)
+			}
+		} else if maxGrey < 256 {
+			b, err := reader.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			grey = int(b)
+		} else {
+			var pixel [2]byte
+			if _, err := io.ReadFull(reader, pixel[:]); err != nil {
+				return nil, err
+			}
+			grey = int(pixel[0])<<8 | int(pixel[1])
+		}
+		heightmap.Heights[i] = float64(grey) / float64(maxGrey) * maxHeight
+	}
+	return heightmap, nil
+}
+
+// pgmToken returns the next whitespace separated token of a PGM header or
+// plain raster, skipping comments. The single whitespace that ends the
+// header of a raw image is consumed with the last token.
+func pgmToken(reader *bufio.Reader) (string, error) {
+	var token []byte
+	for {
+		b, err := reader.ReadByte()
+		if err == io.EOF && len(token) > 0 {
+			return string(token), nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("truncated PGM image")
+		}
+		switch {
+		case b == '#' && len(token) == 0:
+			if _, err := reader.ReadString('\n'); err != nil {
+				return "", fmt.Errorf("truncated PGM image")
+			}
+		case b == ' ' || b == '\t' || b == '\n' || b == '\r':
+			if len(token) > 0 {
+				return string(token), nil
+			}
+		default:
+			token = append(token, b)
+		}
+	}
+}
+
+// validateHeightmap checks that heightmap has a height per cell. A nil
+// heightmap is valid.
+func validateHeightmap(heightmap *engine.Heightmap) error {
+	if heightmap == nil {
+		return nil
+	}
+	if heightmap.Cols <= 0 || heightmap.Rows <= 0 {
+		return fmt.Errorf("cols and rows must be positive")
+	}
+	if len(heightmap.Heights) != heightmap.Cols*heightmap.Rows {
+		return fmt.Errorf("%d heights, want %d", len(heightmap.Heights), heightmap.Cols*heightmap.Rows)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gitlab.utc.fr/cmbouopd/migration.git/engine"
+)
+
+// fieldError reports a field of a request body that is invalid. Field is the
+// JSON path of the field, such as "worldSize" or "flocking.maxSpeed".
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// fieldErrors is the error of a request body with invalid fields.
+type fieldErrors []fieldError
+
+func (e fieldErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Field + ": " + err.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e *fieldErrors) add(field, format string, args ...any) {
+	*e = append(*e, fieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// err returns e as an error, nil if no field is invalid.
+func (e fieldErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e *fieldErrors) positive(field string, value float64) {
+	if value <= 0 {
+		e.add(field, "must be positive")
+	}
+}
+
+func (e *fieldErrors) notNegative(field string, value float64) {
+	if value < 0 {
+		e.add(field, "must not be negative")
+	}
+}
+
+func (e *fieldErrors) between(field string, value, lo, hi float64) {
+	if value < lo || value > hi {
+		e.add(field, "must be between %g and %g", lo, hi)
+	}
+}
+
+// validateConfig checks the ranges of the scalar fields of a configuration
+// and its boundary.
+func validateConfig(config *engine.SimulationConfig) fieldErrors {
+	var errs fieldErrors
+	errs.positive("worldSize", float64(config.WorldSize))
+	errs.notNegative("simulationSpeed", float64(config.SimulationSpeed))
+	errs.notNegative("initialBirds", float64(config.InitialBirds))
+	errs.notNegative("obstacleCount", float64(config.ObstacleCount))
+	errs.notNegative("resourceCount", float64(config.ResourceCount))
+	errs.notNegative("workers", float64(config.Workers))
+	errs.between("captureProbability", config.CaptureProbability, 0, 1)
+	errs.between("collisionMortality", config.CollisionMortality, 0, 1)
+	errs.notNegative("yearLength", float64(config.YearLength))
+	errs.notNegative("dayLength", float64(config.DayLength))
+	errs.notNegative("carryingCapacity", float64(config.CarryingCapacity))
+	errs.between("mutationRate", config.MutationRate, 0, 1)
+	errs.notNegative("mutationScale", config.MutationScale)
+	errs.notNegative("environmentResolution", float64(config.EnvironmentResolution))
+	switch config.Boundary {
+	case "", "clamp", "reflect", "torus", "soft", "open":
+	default:
+		errs.add("boundary", "unknown boundary %q", config.Boundary)
+	}
+
+	for i := range config.Species {
+		field := fmt.Sprintf("species[%d].", i)
+		errs.notNegative(field+"share", config.Species[i].Share)
+		errs = append(errs, validateSpecies(field, &config.Species[i].Species)...)
+	}
+
+	flocking := config.Flocking
+	errs.notNegative("flocking.separationWeight", flocking.SeparationWeight)
+	errs.notNegative("flocking.alignmentWeight", flocking.AlignmentWeight)
+	errs.notNegative("flocking.cohesionWeight", flocking.CohesionWeight)
+	errs.notNegative("flocking.targetWeight", flocking.TargetWeight)
+	errs.notNegative("flocking.perceptionRadius", flocking.PerceptionRadius)
+	errs.between("flocking.fieldOfView", flocking.FieldOfView, 0, 360)
+	errs.notNegative("flocking.maxSpeed", flocking.MaxSpeed)
+	errs.notNegative("flocking.maxForce", flocking.MaxForce)
+	return errs
+}
+
+// validateSpecies checks the parameters of a species, naming its fields
+// after prefix. Zero leaves a parameter to its default.
+func validateSpecies(prefix string, sp *engine.Species) fieldErrors {
+	var errs fieldErrors
+	errs.notNegative(prefix+"speed", sp.Speed)
+	errs.notNegative(prefix+"separationWeight", sp.SeparationWeight)
+	errs.notNegative(prefix+"alignmentWeight", sp.AlignmentWeight)
+	errs.notNegative(prefix+"cohesionWeight", sp.CohesionWeight)
+	errs.between(prefix+"preferredTemperature", sp.PreferredTemperature, -100, 100)
+	errs.notNegative(prefix+"temperatureTolerance", sp.TemperatureTolerance)
+	errs.notNegative(prefix+"predatorVulnerability", sp.PredatorVulnerability)
+	return errs
+}
+
+// validateEnvironment checks the ranges of environmental factors.
+func validateEnvironment(env *engine.EnvironmentalFactors) error {
+	var errs fieldErrors
+	errs.between("temperature", env.Temperature, -100, 100)
+	errs.between("foodAvailability", env.FoodAvailability, 0, 1)
+	errs.between("predatorPresence", env.PredatorPresence, 0, 1)
+	switch env.Wind.Mode {
+	case "", "none", "uniform", "gradient", "noise":
+	default:
+		errs.add("wind.mode", "unknown wind mode %q", env.Wind.Mode)
+	}
+	errs.notNegative("wind.speed", env.Wind.Speed)
+	errs.between("wind.variability", env.Wind.Variability, 0, 1)
+	errs.notNegative("wind.period", float64(env.Wind.Period))
+	errs.notNegative("wind.scale", env.Wind.Scale)
+	return errs.err()
+}
+
+// validateZones checks a list of zones; the simulation needs at least one to
+// place food in.
+func validateZones(zones []engine.Zone) error {
+	var errs fieldErrors
+	if len(zones) == 0 {
+		errs.add("zones", "must not be empty")
+	}
+	ids := make(map[int]bool, len(zones))
+	for i, zone := range zones {
+		field := fmt.Sprintf("[%d].", i)
+		if ids[zone.ID] {
+			errs.add(field+"id", "duplicate zone %d", zone.ID)
+		}
+		ids[zone.ID] = true
+		errs.between(field+"temperature", zone.Temperature, -100, 100)
+		errs.between(field+"foodAvailability", zone.FoodAvailability, 0, 1)
+		errs.between(field+"predatorPresence", zone.PredatorPresence, 0, 1)
+		errs.notNegative(field+"seasonalAmplitude", zone.SeasonalAmplitude)
+		switch zone.Role {
+		case "", "breeding", "wintering":
+		default:
+			errs.add(field+"role", "unknown role %q", zone.Role)
+		}
+	}
+	return errs.err()
+}
+
+// validateTemperatureZones checks a list of temperature zones, at most one
+// per quarter of the world.
+func validateTemperatureZones(zones []engine.TemperatureZone) error {
+	var errs fieldErrors
+	if len(zones) == 0 {
+		errs.add("temperatureZones", "must not be empty")
+	}
+	regions := make(map[int]bool, len(zones))
+	for i, zone := range zones {
+		field := fmt.Sprintf("[%d].", i)
+		errs.between(field+"region", float64(zone.Region), 0, 3)
+		if regions[zone.Region] {
+			errs.add(field+"region", "duplicate region %d", zone.Region)
+		}
+		regions[zone.Region] = true
+		errs.between(field+"temperature", zone.Temperature, -100, 100)
+	}
+	return errs.err()
+}
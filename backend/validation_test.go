@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"gitlab.utc.fr/cmbouopd/migration.git/engine"
+)
+
+func TestPatchConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		patch  string
+		fields []string // Fields reported invalid, none if empty
+		check  func(engine.SimulationConfig) bool
+	}{
+		{name: "scalar", patch: `{"worldSize": 500}`,
+			check: func(c engine.SimulationConfig) bool {
+				return c.WorldSize == 500 && c.InitialBirds == testConfig().InitialBirds
+			}},
+		{name: "nested keeps siblings", patch: `{"flocking": {"maxSpeed": 3}}`,
+			check: func(c engine.SimulationConfig) bool {
+				return c.Flocking.MaxSpeed == 3 && c.Flocking.CohesionWeight == 2
+			}},
+		{name: "null resets", patch: `{"obstacles": null}`,
+			check: func(c engine.SimulationConfig) bool { return len(c.Obstacles) == 0 }},
+		{name: "array replaced", patch: `{"obstacles": [{"shape": "polyline", "points": [[0, 0], [10, 10]], "height": 5}]}`,
+			check: func(c engine.SimulationConfig) bool {
+				return len(c.Obstacles) == 1 && c.Obstacles[0].Shape == "polyline"
+			}},
+		{name: "large seed", patch: `{"seed": 9007199254740993}`,
+			check: func(c engine.SimulationConfig) bool { return c.Seed == 9007199254740993 }},
+		{name: "unknown field", patch: `{"birds": 10}`, fields: []string{"birds"}},
+		{name: "unknown nested field", patch: `{"flocking": {"speed": 3}}`, fields: []string{"flocking.speed"}},
+		{name: "wrong type", patch: `{"worldSize": "large"}`, fields: []string{"worldSize"}},
+		{name: "wrong nested type", patch: `{"flocking": {"maxSpeed": "fast"}}`, fields: []string{"flocking.maxSpeed"}},
+		{name: "out of range", patch: `{"worldSize": 0, "captureProbability": 2}`, fields: []string{"worldSize", "captureProbability"}},
+		{name: "nested out of range", patch: `{"flocking": {"fieldOfView": 400, "maxForce": -1}}`, fields: []string{"flocking.fieldOfView", "flocking.maxForce"}},
+		{name: "species", patch: `{"species": [{"name": "swift", "speed": -1, "share": -2, "cohesionWeight": -1, "temperatureTolerance": -5}]}`,
+			fields: []string{"species[0].share", "species[0].speed", "species[0].cohesionWeight", "species[0].temperatureTolerance"}},
+		{name: "unknown boundary", patch: `{"boundary": "sphere"}`, fields: []string{"boundary"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.Flocking.CohesionWeight = 2
+			err := applyPatch(&config, []byte(test.patch))
+			if err == nil {
+				err = validateConfig(&config).err()
+			}
+			checkFields(t, err, test.fields)
+			if err == nil && test.check != nil && !test.check(config) {
+				t.Errorf("patched config %+v", config)
+			}
+		})
+	}
+}
+
+func TestPatchEnvironment(t *testing.T) {
+	tests := []struct {
+		name   string
+		patch  string
+		fields []string
+	}{
+		{name: "valid", patch: `{"temperature": -5, "wind": {"mode": "noise", "scale": 2}}`},
+		{name: "temperature", patch: `{"temperature": 150}`, fields: []string{"temperature"}},
+		{name: "shares", patch: `{"foodAvailability": 1.5, "predatorPresence": -0.1}`, fields: []string{"foodAvailability", "predatorPresence"}},
+		{name: "wind mode", patch: `{"wind": {"mode": "storm"}}`, fields: []string{"wind.mode"}},
+		{name: "wind variability", patch: `{"wind": {"variability": 2}}`, fields: []string{"wind.variability"}},
+		{name: "unknown wind field", patch: `{"wind": {"gusts": 1}}`, fields: []string{"wind.gusts"}},
+		{name: "wrong type", patch: `{"temperature": "warm"}`, fields: []string{"temperature"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := testEnvironment()
+			err := applyPatch(&env, []byte(test.patch))
+			if err == nil {
+				err = validateEnvironment(&env)
+			}
+			checkFields(t, err, test.fields)
+		})
+	}
+}
+
+func TestPatchNotAnObject(t *testing.T) {
+	config := testConfig()
+	for _, patch := range []string{`[]`, `3`, `null`, `{`} {
+		if err := applyPatch(&config, []byte(patch)); err == nil {
+			t.Errorf("patch %s accepted", patch)
+		}
+	}
+}
+
+// checkFields fails t unless err reports exactly fields as invalid.
+func checkFields(t *testing.T, err error, fields []string) {
+	t.Helper()
+	if len(fields) == 0 {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return
+	}
+	var errs fieldErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("error %v, want invalid fields %v", err, fields)
+	}
+	if len(errs) != len(fields) {
+		t.Fatalf("invalid fields %v, want %v", errs, fields)
+	}
+	for i, field := range fields {
+		if errs[i].Field != field {
+			t.Errorf("invalid field %q, want %q", errs[i].Field, field)
+		}
+	}
+}
+
+func TestPostSpecies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	saved := catalog
+	t.Cleanup(func() { catalog = saved })
+	catalog = &speciesCatalog{species: map[string]engine.Species{engine.DefaultSpecies.Name: engine.DefaultSpecies}}
+	router := gin.New()
+	registerSpeciesRoutes(router)
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{body: `{"name": "swift", "speed": 1.5, "diet": ["insects"], "preferredTemperature": 22}`, status: http.StatusCreated},
+		{body: `{"name": "swift", "speed": 2}`, status: http.StatusOK},
+		{body: `{"speed": 1}`, status: http.StatusBadRequest},
+		{body: `{"name": "stone", "speed": -1}`, status: http.StatusBadRequest},
+		{body: `{"name": "stone", "predatorVulnerability": -0.5}`, status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		if recorder := serve(router, "POST", "/species", test.body); recorder.Code != test.status {
+			t.Errorf("POST /species %s: status %d, want %d: %s", test.body, recorder.Code, test.status, recorder.Body)
+		}
+	}
+	if _, ok := catalog.get("stone"); ok {
+		t.Error("an invalid species was stored")
+	}
+}
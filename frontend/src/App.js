@@ -15,6 +15,7 @@ function App() {
     obstacles: [],
     resources: [],
     collisionCount: 0,
+    strikeCount: 0,
   });
 
   // Fetch the simulation state on component mount
@@ -94,6 +95,10 @@ function App() {
             <h3>Collisions:</h3>
             <p>{simulationState.collisionCount}</p>
           </div>
+          <div>
+            <h3>Obstacle Strikes:</h3>
+            <p>{simulationState.strikeCount}</p>
+          </div>
           <div>
             <h3>Legend:</h3>
             <p><span style={{ color: 'green' }}>●</span> Migrating Bird</p>
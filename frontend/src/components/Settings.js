@@ -1,5 +1,5 @@
 import React, { useState, useEffect } from 'react';
-import { fetchSimulationConfig, updateSimulationConfig, setTimeStep, fetchTimeStep } from '../utils/api';
+import { fetchSimulationConfig, patchSimulationConfig, setTimeStep, fetchTimeStep } from '../utils/api';
 
 const Settings = () => {
   const [config, setConfig] = useState({ simulationSpeed: 100, worldSize: 1000, initialBirds: 50 });
@@ -35,10 +35,7 @@ const Settings = () => {
     const { name, value } = e.target;
     setConfig(prevConfig => ({ ...prevConfig, [name]: parseInt(value, 10) }));
     try {
-        await updateSimulationConfig({
-            ...config,
-            [name]: parseInt(value, 10),
-          });
+        await patchSimulationConfig({ [name]: parseInt(value, 10) });
     } catch (error) {
        console.error("Failed to update config:", error)
     }
@@ -38,8 +38,27 @@ const SimulationCanvas = ({ simulationState }) => {
         ctx.clearRect(0, 0, width, height);
         console.log("Updated simulationState:", simulationState);
 
-        // Draw obstacles as mountains
+        // Draw mountains, and structures as their outline
         simulationState.obstacles?.forEach((obstacle) => {
+            if (obstacle.shape === "polygon" || obstacle.shape === "polyline") {
+                ctx.beginPath();
+                obstacle.points.forEach((point, i) => {
+                    if (i === 0) {
+                        ctx.moveTo(point[0] * scaleX, point[1] * scaleY);
+                    } else {
+                        ctx.lineTo(point[0] * scaleX, point[1] * scaleY);
+                    }
+                });
+                if (obstacle.shape === "polygon") {
+                    ctx.closePath();
+                    ctx.fillStyle = "gray";
+                    ctx.fill();
+                }
+                ctx.strokeStyle = "dimgray";
+                ctx.lineWidth = 3;
+                ctx.stroke();
+                return;
+            }
             ctx.drawImage(mountainImg, obstacle.position[0] * scaleX, obstacle.position[1] * scaleY, obstacle.radius * scaleX * obstacleSize, obstacle.radius * scaleY * obstacleSize);
         });
 
@@ -49,6 +49,15 @@ export const updateSimulationConfig = async (config) => {
     }
 };
 
+export const patchSimulationConfig = async (changes) => {
+    try {
+        await axios.patch(`${API_URL}/simulation/config`, changes);
+    } catch (error) {
+        console.error("Error updating simulation config:", error);
+        throw error;
+    }
+};
+
 export const setTimeStep = async (timeStep) => {
     try {
         await axios.post(`${API_URL}/simulation/time-step`, { timeStep });
@@ -79,7 +88,7 @@ export const saveSimulation = async () => {
 
 export const loadSimulation = async () => {
     try {
-        const response = await axios.get(`${API_URL}/simulation/load`);
+        const response = await axios.post(`${API_URL}/simulation/load`);
         return response.data;
     } catch (error) {
         console.error("Error loading simulation:", error);